@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type permissionsCacheEntry struct {
+	permissions Permissions
+	expiresAt   time.Time
+}
+
+// PermissionsCache keeps the effective permissions of recently seen users in
+// memory so requirePermission does not hit the database on every request.
+type PermissionsCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	entries    map[int64]permissionsCacheEntry
+	generation uint64
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+func NewPermissionsCache(ttl time.Duration) *PermissionsCache {
+	return &PermissionsCache{
+		ttl:     ttl,
+		entries: make(map[int64]permissionsCacheEntry),
+	}
+}
+
+// Get returns the cached permissions of the user. On a miss it also returns the
+// current generation which must be handed back to Set, so a value loaded before
+// an invalidation is never stored.
+func (c *PermissionsCache) Get(userID int64) (Permissions, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[userID]
+	if ok && time.Now().Before(e.expiresAt) {
+		c.hits.Add(1)
+		return e.permissions, c.generation, true
+	}
+	if ok {
+		delete(c.entries, userID)
+	}
+	c.misses.Add(1)
+	return nil, c.generation, false
+}
+
+func (c *PermissionsCache) Set(userID int64, p Permissions, generation uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.entries[userID] = permissionsCacheEntry{
+		permissions: p,
+		expiresAt:   time.Now().Add(c.ttl),
+	}
+}
+
+func (c *PermissionsCache) Invalidate(userIDs ...int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, id := range userIDs {
+		delete(c.entries, id)
+	}
+}
+
+func (c *PermissionsCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	clear(c.entries)
+}
+
+func (c *PermissionsCache) Stats() map[string]any {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return map[string]any{
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"entries": entries,
+		"ttl":     c.ttl.String(),
+	}
+}
+
+// RevocationList mirrors the revoked_sessions table so stateless authentication
+// tokens can be rejected without a database lookup. It is reloaded periodically
+// and sessions revoked by this instance are added right away.
+type RevocationList struct {
+	mu       sync.RWMutex
+	sessions map[int64]time.Time
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		sessions: make(map[int64]time.Time),
+	}
+}
+
+func (l *RevocationList) IsRevoked(sessionID int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.sessions[sessionID]
+	return ok
+}
+
+func (l *RevocationList) Add(sessionID int64, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions[sessionID] = expiresAt
+}
+
+func (l *RevocationList) Replace(sessions map[int64]time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions = sessions
+}
+
+func (l *RevocationList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.sessions)
+}
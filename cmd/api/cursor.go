@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Cursor marks a row of a keyset paginated listing by its sort key and id.
+// Clients only see it encoded, so its fields can change without notice.
+type Cursor struct {
+	// Sort is the sort option the cursor was issued for, a cursor cannot be
+	// used with another one.
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int64  `json:"i"`
+	// Before reads the page preceding the row instead of the one following
+	// it.
+	Before bool `json:"b,omitempty"`
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &Cursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Pagination is the metadata of a page of a listing. Offset pages report the
+// page number and total, cursor pages the cursors of their neighbours.
+type Pagination struct {
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"page_size"`
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// keyset orders a listing by a sort expression with the id as tie breaker.
+type keyset struct {
+	column string
+	// typ is the SQL type the text of a cursor key is cast back to.
+	typ  string
+	desc bool
+}
+
+// apply adds the condition selecting the rows past the cursor, if any, and
+// returns the ORDER BY clause reading them away from it.
+func (k keyset) apply(b *whereBuilder, c *Cursor, idColumn string) string {
+	desc := k.desc
+	if c != nil && c.Before {
+		desc = !desc
+	}
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+	if k.column == idColumn {
+		if c != nil {
+			b.add(fmt.Sprintf("%s %s %s", idColumn, op, b.arg(c.ID)))
+		}
+		return fmt.Sprintf("%s %s", idColumn, dir)
+	}
+	if c != nil {
+		b.add(fmt.Sprintf("(%s, %s) %s (%s::%s, %s)", k.column, idColumn, op, b.arg(c.Key), k.typ, b.arg(c.ID)))
+	}
+	return fmt.Sprintf("%s %s, %s %s", k.column, dir, idColumn, dir)
+}
+
+// timestampLayouts are the text forms of a timestamptz in the ISO date style,
+// the offset only has minutes or seconds when they are not zero.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+}
+
+// validKey tells whether the key of a cursor can be cast to the type of the
+// keyset. Cursors come from the client, so a tampered key must be rejected
+// before it reaches the query.
+func (k keyset) validKey(key string) bool {
+	if strings.ContainsRune(key, 0) {
+		return false
+	}
+	switch k.typ {
+	case "bigint":
+		_, err := strconv.ParseInt(key, 10, 64)
+		return err == nil
+	case "real":
+		_, err := strconv.ParseFloat(key, 32)
+		return err == nil && !strings.ContainsAny(key, "xX_")
+	case "numeric":
+		_, err := decimal.NewFromString(key)
+		return err == nil && !strings.ContainsAny(key, "eE")
+	case "timestamptz":
+		for _, layout := range timestampLayouts {
+			if _, err := time.Parse(layout, key); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type keyedRow[T any] struct {
+	row T
+	key string
+	id  int64
+}
+
+// paginate turns the rows read by keyset.apply, with one extra row to tell
+// whether there are more, into a page in listing order and its cursors.
+func paginate[T any](rows []keyedRow[T], c *Cursor, sort string, pageSize int) ([]T, Pagination) {
+	more := len(rows) > pageSize
+	if more {
+		rows = rows[:pageSize]
+	}
+	backward := c != nil && c.Before
+	if backward {
+		slices.Reverse(rows)
+	}
+
+	p := Pagination{
+		PageSize: pageSize,
+	}
+	page := make([]T, len(rows))
+	for i := range rows {
+		page[i] = rows[i].row
+	}
+	if len(rows) == 0 {
+		return page, p
+	}
+	hasNext := more || backward
+	hasPrev := c != nil && (!backward || more)
+	if hasNext {
+		last := rows[len(rows)-1]
+		p.NextCursor = Cursor{Sort: sort, Key: last.key, ID: last.id}.Encode()
+	}
+	if hasPrev {
+		first := rows[0]
+		p.PrevCursor = Cursor{Sort: sort, Key: first.key, ID: first.id, Before: true}.Encode()
+	}
+	return page, p
+}
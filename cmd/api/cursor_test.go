@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	valid := Cursor{Sort: "-price", Key: "10.5", ID: 7, Before: true}
+	tests := []struct {
+		name   string
+		cursor string
+		want   *Cursor
+	}{
+		{"round trip", valid.Encode(), &valid},
+		{"not base64", "not a cursor!", nil},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("cursor")), nil},
+		{"zero id", Cursor{Sort: "id", Key: "0"}.Encode(), nil},
+		{"negative id", Cursor{Sort: "id", ID: -1}.Encode(), nil},
+	}
+	for _, tt := range tests {
+		c, err := DecodeCursor(tt.cursor)
+		if tt.want == nil {
+			if err != ErrInvalidCursor {
+				t.Errorf("%s: DecodeCursor error = %v, want ErrInvalidCursor", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || *c != *tt.want {
+			t.Errorf("%s: DecodeCursor = %+v, %v, want %+v", tt.name, c, err, *tt.want)
+		}
+	}
+}
+
+func TestKeysetValidKey(t *testing.T) {
+	tests := []struct {
+		typ   string
+		key   string
+		valid bool
+	}{
+		{"bigint", "42", true},
+		{"bigint", "4.2", false},
+		{"bigint", "1; DROP TABLE products", false},
+		{"real", "0.0607927", true},
+		{"real", "1e-05", true},
+		{"real", "0x1p-2", false},
+		{"real", "1e50", false},
+		{"numeric", "19.99", true},
+		{"numeric", "1e999999", false},
+		{"numeric", "abc", false},
+		{"timestamptz", "2024-05-01 10:11:12.123456+00", true},
+		{"timestamptz", "2024-05-01 10:11:12+05:30", true},
+		{"timestamptz", "2024-05-01", false},
+		{"text", "any name", true},
+		{"text", "nul\x00byte", false},
+	}
+	for _, tt := range tests {
+		k := keyset{column: "c", typ: tt.typ}
+		if got := k.validKey(tt.key); got != tt.valid {
+			t.Errorf("validKey(%q) for %s = %t, want %t", tt.key, tt.typ, got, tt.valid)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	// rows builds the rows read by keyset.apply, in reading order
+	rows := func(ids ...int64) []keyedRow[int64] {
+		keyed := make([]keyedRow[int64], len(ids))
+		for i, id := range ids {
+			keyed[i] = keyedRow[int64]{row: id, key: strconv.FormatInt(id, 10), id: id}
+		}
+		return keyed
+	}
+	cursor := func(id int64, before bool) *Cursor {
+		return &Cursor{Sort: "id", Key: strconv.FormatInt(id, 10), ID: id, Before: before}
+	}
+
+	tests := []struct {
+		name   string
+		rows   []keyedRow[int64]
+		cursor *Cursor
+		page   []int64
+		next   *Cursor
+		prev   *Cursor
+	}{
+		{"empty listing", rows(), nil, []int64{}, nil, nil},
+		{"single first page", rows(1, 2), nil, []int64{1, 2}, nil, nil},
+		{"first page", rows(1, 2, 3), nil, []int64{1, 2}, cursor(2, false), nil},
+		{"middle page", rows(3, 4, 5), cursor(2, false), []int64{3, 4}, cursor(4, false), cursor(3, true)},
+		{"last page", rows(5), cursor(4, false), []int64{5}, nil, cursor(5, true)},
+		{"past the last page", rows(), cursor(5, false), []int64{}, nil, nil},
+		{"backward middle page", rows(4, 3, 2), cursor(5, true), []int64{3, 4}, cursor(4, false), cursor(3, true)},
+		{"backward first page", rows(2, 1), cursor(3, true), []int64{1, 2}, cursor(2, false), nil},
+	}
+	for _, tt := range tests {
+		page, p := paginate(tt.rows, tt.cursor, "id", 2)
+		if !slices.Equal(page, tt.page) {
+			t.Errorf("%s: page = %v, want %v", tt.name, page, tt.page)
+		}
+		if p.PageSize != 2 || p.Page != 0 || p.Total != nil {
+			t.Errorf("%s: pagination = %+v, want a cursor page of 2", tt.name, p)
+		}
+		for _, c := range []struct {
+			name    string
+			encoded string
+			want    *Cursor
+		}{
+			{"next", p.NextCursor, tt.next},
+			{"prev", p.PrevCursor, tt.prev},
+		} {
+			if c.want == nil {
+				if c.encoded != "" {
+					t.Errorf("%s: %s cursor = %q, want none", tt.name, c.name, c.encoded)
+				}
+				continue
+			}
+			got, err := DecodeCursor(c.encoded)
+			if err != nil || *got != *c.want {
+				t.Errorf("%s: %s cursor = %+v, %v, want %+v", tt.name, c.name, got, err, *c.want)
+			}
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"slices"
+	"strconv"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -15,14 +21,33 @@ type User struct {
 	PasswordHash []byte          `json:"-"`
 	IsActivated  bool            `json:"is_activated"`
 	Balance      decimal.Decimal `json:"balance"`
+	SuspendedAt  *time.Time      `json:"suspended_at,omitempty"`
 	Version      int32           `json:"-"`
 }
 
+// UserFilter holds the optional criteria of the admin user listing. Nil and
+// zero fields are not applied.
+type UserFilter struct {
+	Email         string
+	IsActivated   *bool
+	IsSuspended   *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Sort          string
+	Page          int
+	PageSize      int
+}
+
 type TokenScope string
 
 const (
 	ScopeAuthentication TokenScope = "authentication"
 	ScopeActivation     TokenScope = "activation"
+	ScopePasswordReset  TokenScope = "password-reset"
+	ScopeRefresh        TokenScope = "refresh"
+	ScopeMFA            TokenScope = "mfa"
+	ScopeEmailChange    TokenScope = "email-change"
+	ScopeEmailRevert    TokenScope = "email-revert"
 )
 
 type Token struct {
@@ -32,25 +57,533 @@ type Token struct {
 	UserID    int64      `json:"-"`
 	ExpiresAt time.Time  `json:"expiry"`
 	Scope     TokenScope `json:"-"`
+	FamilyID  int64      `json:"-"`
+}
+
+type OAuthState struct {
+	State        string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
+
+type EmailChange struct {
+	ID          int64
+	UserID      int64
+	CreatedAt   time.Time
+	OldEmail    string
+	NewEmail    string
+	ConfirmedAt time.Time
+}
+
+type TOTP struct {
+	UserID       int64
+	CreatedAt    time.Time
+	Secret       string
+	IsEnabled    bool
+	LastUsedStep int64
+}
+
+type LoginAttempt struct {
+	Email        string
+	Failures     int
+	LastFailedAt time.Time
+	LockedUntil  time.Time
+}
+
+// RetryAfter returns how long the account has to wait before the next login
+// attempt is accepted. Past freeFailures every failure doubles the delay.
+func (a *LoginAttempt) RetryAfter(freeFailures int, maxDelay time.Duration) time.Duration {
+	now := time.Now()
+	if a.LockedUntil.After(now) {
+		return a.LockedUntil.Sub(now)
+	}
+	if a.Failures <= freeFailures {
+		return 0
+	}
+	delay := maxDelay
+	if shift := a.Failures - freeFailures - 1; shift < 16 {
+		delay = min(time.Second<<shift, maxDelay)
+	}
+	return max(time.Until(a.LastFailedAt.Add(delay)), 0)
+}
+
+type Session struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// APIKey is a long-lived credential for integrations. It acts on behalf of
+// its owner but is limited to the permissions it was created with. Text is
+// only set when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Text        string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	ExpiresAt   *time.Time  `json:"expires_at"`
 }
 
 type Product struct {
-	ID          int64           `json:"id"`
-	CreatedAt   time.Time       `json:"created_at"`
-	UpdatedAt   time.Time       `json:"updated_at"`
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// SKU is optional, it identifies the product in bulk imports.
+	SKU         string          `json:"sku"`
 	Name        string          `json:"name"`
 	Description string          `json:"description"`
 	Price       decimal.Decimal `json:"price"`
 	Quantity    int64           `json:"quantity"`
-	Version     int32           `json:"-"`
+	CategoryIDs []int64         `json:"category_ids"`
+	// Options are the axes the variants of the product differ in, e.g. size
+	// and color.
+	Options  []string         `json:"options"`
+	Variants []ProductVariant `json:"variants,omitempty"`
+	Images   []ProductImage   `json:"images"`
+	// Attributes maps the code of each attribute set on the product to its
+	// value, a string, number or boolean depending on the attribute type.
+	Attributes map[string]any `json:"attributes"`
+	Status     ProductStatus  `json:"status"`
+	// PublishAt and UnpublishAt schedule the next status change of the
+	// product, they are cleared once it happened.
+	PublishAt   *time.Time `json:"publish_at"`
+	UnpublishAt *time.Time `json:"unpublish_at"`
+	// Search is only set in the listing when it is filtered by a search query.
+	Search  *ProductSearchResult `json:"search,omitempty"`
+	Version int32                `json:"-"`
+}
+
+// ProductStatus is the lifecycle state of a product, only published products
+// are listed publicly and can be bought.
+type ProductStatus string
+
+const (
+	ProductDraft     ProductStatus = "draft"
+	ProductPublished ProductStatus = "published"
+	ProductArchived  ProductStatus = "archived"
+)
+
+var productStatuses = []ProductStatus{ProductDraft, ProductPublished, ProductArchived}
+
+// SetStatus changes the status by hand, which overrides the schedule it made
+// moot.
+func (p *Product) SetStatus(status ProductStatus) {
+	p.Status = status
+	if p.Status != ProductDraft {
+		p.PublishAt = nil
+	}
+	if p.Status == ProductArchived {
+		p.UnpublishAt = nil
+	}
+}
+
+type ProductChangeAction string
+
+const (
+	ProductCreated ProductChangeAction = "create"
+	ProductUpdated ProductChangeAction = "update"
+	ProductDeleted ProductChangeAction = "delete"
+)
+
+// ProductChange is an entry of the history of a product. Updates also cover
+// the variants, attributes and images of the product, whose fields are named
+// variants.<id>.<field>, attributes.<code> and images.
+type ProductChange struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ProductID int64     `json:"product_id"`
+	// UserID is the user who made the change, nil for the changes made by
+	// the publishing schedule or by users who were deleted since.
+	UserID  *int64                 `json:"user_id"`
+	Action  ProductChangeAction    `json:"action"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+// FieldChange holds the JSON values of a field before and after a change,
+// null before a creation and after a deletion.
+type FieldChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// productHistoryFields returns the fields of the product recorded in its
+// history, stock changes made by orders are recorded with the orders. The
+// values are normalized so that equal fields encode the same.
+func productHistoryFields(p *Product) map[string]any {
+	utc := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		u := t.UTC()
+		return &u
+	}
+	categoryIDs := append([]int64{}, p.CategoryIDs...)
+	slices.Sort(categoryIDs)
+	return map[string]any{
+		"sku":          p.SKU,
+		"name":         p.Name,
+		"description":  p.Description,
+		"price":        p.Price,
+		"quantity":     p.Quantity,
+		"category_ids": categoryIDs,
+		"options":      append([]string{}, p.Options...),
+		"status":       p.Status,
+		"publish_at":   utc(p.PublishAt),
+		"unpublish_at": utc(p.UnpublishAt),
+	}
+}
+
+// diffProducts returns the recorded fields that differ between the two
+// versions of a product, before is nil for a creation and after for a
+// deletion.
+func diffProducts(before, after *Product) (map[string]FieldChange, error) {
+	fields := func(p *Product) map[string]any {
+		if p == nil {
+			return nil
+		}
+		return productHistoryFields(p)
+	}
+	return diffFields(fields(before), fields(after))
+}
+
+// variantHistoryFields returns the fields of the variant recorded in the
+// history of its product, prefixed with the variant so that the changes of
+// several variants do not collide.
+func variantHistoryFields(v *ProductVariant) map[string]any {
+	if v == nil {
+		return nil
+	}
+	prefix := fmt.Sprintf("variants.%d.", v.ID)
+	return map[string]any{
+		prefix + "sku":      v.SKU,
+		prefix + "options":  v.Options,
+		prefix + "price":    v.Price,
+		prefix + "quantity": v.Quantity,
+	}
+}
+
+// attributeHistoryFields returns the attribute values keyed by code as they
+// are recorded in the history of the product.
+func attributeHistoryFields(values map[string]any) map[string]any {
+	fields := make(map[string]any, len(values))
+	for code, value := range values {
+		fields["attributes."+code] = value
+	}
+	return fields
+}
+
+// diffFields returns the fields whose JSON value differs between before and
+// after, a field missing on one side is null there.
+func diffFields(before, after map[string]any) (map[string]FieldChange, error) {
+	encode := func(fields map[string]any, field string) (json.RawMessage, error) {
+		value, ok := fields[field]
+		if !ok {
+			return json.RawMessage("null"), nil
+		}
+		return json.Marshal(value)
+	}
+
+	changes := map[string]FieldChange{}
+	for _, fields := range []map[string]any{before, after} {
+		for field := range fields {
+			if _, ok := changes[field]; ok {
+				continue
+			}
+			b, err := encode(before, field)
+			if err != nil {
+				return nil, err
+			}
+			a, err := encode(after, field)
+			if err != nil {
+				return nil, err
+			}
+			changes[field] = FieldChange{Before: b, After: a}
+		}
+	}
+	for field, c := range changes {
+		if bytes.Equal(c.Before, c.After) {
+			delete(changes, field)
+		}
+	}
+	return changes, nil
+}
+
+// ProductSearchResult tells how well a product matched the search query, the
+// highlights are HTML escaped text with the matched words wrapped in <mark>
+// tags.
+type ProductSearchResult struct {
+	Rank                 float64 `json:"rank"`
+	NameHighlight        string  `json:"name_highlight"`
+	DescriptionHighlight string  `json:"description_highlight"`
+}
+
+type ProductImage struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ProductID   int64     `json:"product_id"`
+	Key         string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Position    int       `json:"position"`
+	// URL and Thumbnails are set from the image store before the image is
+	// returned, Thumbnails maps each thumbnail width to its URL.
+	URL        string            `json:"url"`
+	Thumbnails map[string]string `json:"thumbnails"`
+}
+
+// VariantOptions maps each option axis of the product to the value of the
+// variant, e.g. {"size": "M", "color": "red"}.
+type VariantOptions map[string]string
+
+func (o VariantOptions) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(o)
+}
+
+func (o *VariantOptions) Scan(src any) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return errors.New("variant options must be scanned from bytes")
+	}
+	return json.Unmarshal(data, o)
+}
+
+type ProductVariant struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	ProductID int64          `json:"product_id"`
+	SKU       string         `json:"sku"`
+	Options   VariantOptions `json:"options"`
+	// Price overrides the price of the product when set.
+	Price    *decimal.Decimal `json:"price"`
+	Quantity int64            `json:"quantity"`
+	Version  int32            `json:"-"`
+}
+
+// ProductFilter holds the criteria of the product listing.
+type ProductFilter struct {
+	// Query is a web search style query over the name and description, it
+	// is stemmed and matches in the name weigh more.
+	Query       string
+	Name        string
+	Description string
+	MinPrice    decimal.Decimal
+	MaxPrice    decimal.Decimal
+	// CategoryID limits the listing to the category and its descendants, zero
+	// means any category.
+	CategoryID int64
+	// InStock limits the listing to products that can or cannot be bought,
+	// nil means both.
+	InStock *bool
+	// Attributes must all match.
+	Attributes []AttributeFilter
+	// Status limits the listing to products in this state, empty means any.
+	Status ProductStatus
+	Sort   string
+	// Page is the page number of an offset page, zero reads the page after
+	// Cursor instead, or the first one when it is nil.
+	Page     int
+	Cursor   *Cursor
+	PageSize int
+}
+
+type AttributeType string
+
+const (
+	AttributeString  AttributeType = "string"
+	AttributeNumber  AttributeType = "number"
+	AttributeBoolean AttributeType = "boolean"
+	AttributeEnum    AttributeType = "enum"
+)
+
+// Attribute defines a structured specification of products, e.g. brand or
+// weight. Attributes without a category apply to every product, the others to
+// the products of the category and its subcategories.
+type Attribute struct {
+	ID         int64         `json:"id"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	CategoryID *int64        `json:"category_id"`
+	Code       string        `json:"code"`
+	Name       string        `json:"name"`
+	Type       AttributeType `json:"type"`
+	Unit       string        `json:"unit"`
+	EnumValues []string      `json:"enum_values"`
+	Version    int32         `json:"-"`
+}
+
+// ParseValue parses the value of the attribute from its text, as given in a
+// query string.
+func (a *Attribute) ParseValue(s string) (*AttributeValue, error) {
+	v := &AttributeValue{AttributeID: a.ID}
+	switch a.Type {
+	case AttributeNumber:
+		n, err := decimal.NewFromString(s)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		v.Number = &n
+	case AttributeBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		v.Boolean = &b
+	case AttributeEnum:
+		if slices.Index(a.EnumValues, s) == -1 {
+			return nil, fmt.Errorf("must be one of %q", a.EnumValues)
+		}
+		v.Text = &s
+	default:
+		if s == "" || len(s) > 255 {
+			return nil, errors.New("must be between 1 and 255 characters")
+		}
+		v.Text = &s
+	}
+	return v, nil
+}
+
+// ParseJSONValue parses the value of the attribute from a JSON value of the
+// matching type.
+func (a *Attribute) ParseJSONValue(raw json.RawMessage) (*AttributeValue, error) {
+	switch a.Type {
+	case AttributeNumber:
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return a.ParseValue(n.String())
+	case AttributeBoolean:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return a.ParseValue(strconv.FormatBool(b))
+	default:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		return a.ParseValue(s)
+	}
+}
+
+// AttributeValue is the value of an attribute on a product, only the field of
+// the attribute type is set.
+type AttributeValue struct {
+	AttributeID int64
+	Text        *string
+	Number      *decimal.Decimal
+	Boolean     *bool
+}
+
+// AttributeFilter matches the products whose attribute equals the value or,
+// for numbers, lies within Min and Max. Nil bounds are open.
+type AttributeFilter struct {
+	Attribute Attribute
+	Equals    *AttributeValue
+	Min       *decimal.Decimal
+	Max       *decimal.Decimal
+}
+
+type ProductSuggestion struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	Similarity float64 `json:"similarity,omitempty"`
+}
+
+// ProductFacets summarizes the products matching a filter for the storefront
+// sidebar.
+type ProductFacets struct {
+	Price        []PriceFacet            `json:"price"`
+	Categories   []CategoryFacet         `json:"categories"`
+	Availability AvailabilityFacet       `json:"availability"`
+	Options      map[string][]FacetValue `json:"options"`
+	// Attributes counts the values of the string, enum and boolean
+	// attributes by attribute code.
+	Attributes map[string][]FacetValue `json:"attributes"`
+}
+
+// PriceFacet counts the products with min <= price < max, a nil bound is
+// open.
+type PriceFacet struct {
+	Min   *decimal.Decimal `json:"min"`
+	Max   *decimal.Decimal `json:"max"`
+	Count int              `json:"count"`
+}
+
+// CategoryFacet counts the products assigned directly to the category.
+type CategoryFacet struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type AvailabilityFacet struct {
+	InStock    int `json:"in_stock"`
+	OutOfStock int `json:"out_of_stock"`
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type Category struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	ParentID    *int64      `json:"parent_id"`
+	Name        string      `json:"name"`
+	Slug        string      `json:"slug"`
+	Description string      `json:"description"`
+	Children    []*Category `json:"children,omitempty"`
+	Version     int32       `json:"-"`
+}
+
+// buildCategoryTree nests the categories under their parents and returns the
+// roots. The order of the input is kept among siblings.
+func buildCategoryTree(categories []Category) []*Category {
+	nodes := make(map[int64]*Category, len(categories))
+	for i := range categories {
+		nodes[categories[i].ID] = &categories[i]
+	}
+	roots := []*Category{}
+	for i := range categories {
+		c := &categories[i]
+		if c.ParentID != nil {
+			if parent, ok := nodes[*c.ParentID]; ok {
+				parent.Children = append(parent.Children, c)
+				continue
+			}
+		}
+		roots = append(roots, c)
+	}
+	return roots
 }
 
 type CartItem struct {
-	ID        int64 `json:"id"`
-	ProductID int64 `json:"product_id"`
-	UserID    int64 `json:"-"`
-	Quantity  int64 `json:"quantity"`
-	Version   int32 `json:"-"`
+	ID        int64  `json:"id"`
+	ProductID int64  `json:"product_id"`
+	VariantID *int64 `json:"variant_id"`
+	UserID    int64  `json:"-"`
+	Quantity  int64  `json:"quantity"`
+	Version   int32  `json:"-"`
 }
 
 type OrderStatusID int64
@@ -79,6 +612,7 @@ type OrderItem struct {
 	ID        int64           `json:"id"`
 	OrderID   int64           `json:"order_id"`
 	ProductID int64           `json:"product_id"`
+	VariantID *int64          `json:"variant_id"`
 	Quantity  int64           `json:"quantity"`
 	Price     decimal.Decimal `json:"price"`
 }
@@ -95,8 +629,54 @@ type Transation struct {
 	Amount    decimal.Decimal `json:"amount"`
 }
 
+type ProductImportStatus string
+
+const (
+	ImportPending   ProductImportStatus = "pending"
+	ImportRunning   ProductImportStatus = "running"
+	ImportCompleted ProductImportStatus = "completed"
+	ImportFailed    ProductImportStatus = "failed"
+)
+
+// ProductImport is a bulk product import processed in the background, its
+// counters report the progress while it runs.
+type ProductImport struct {
+	ID            int64               `json:"id"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+	FinishedAt    *time.Time          `json:"finished_at"`
+	UserID        int64               `json:"user_id"`
+	Format        string              `json:"format"`
+	DryRun        bool                `json:"dry_run"`
+	Status        ProductImportStatus `json:"status"`
+	TotalRows     int                 `json:"total_rows"`
+	ProcessedRows int                 `json:"processed_rows"`
+	CreatedRows   int                 `json:"created_rows"`
+	UpdatedRows   int                 `json:"updated_rows"`
+	FailedRows    int                 `json:"failed_rows"`
+	// Errors lists the validation errors of the failed rows, only the first
+	// maxProductImportErrors are kept.
+	Errors []ProductImportError `json:"errors"`
+	// Error is set when the import failed as a whole.
+	Error string `json:"error,omitempty"`
+}
+
+type ProductImportError struct {
+	// Row is the 1-based position of the row in the file, not counting the
+	// CSV header.
+	Row    int               `json:"row"`
+	Errors map[string]string `json:"errors"`
+}
+
 type Permissions []string
 
 func (p Permissions) Has(code string) bool {
 	return slices.Index(p, code) != -1
 }
+
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestDiffProducts(t *testing.T) {
+	publishAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	publishAtElsewhere := publishAt.In(time.FixedZone("UTC+2", 2*60*60))
+	unpublishAt := publishAt.AddDate(0, 1, 0)
+	product := func(change func(p *Product)) *Product {
+		p := &Product{
+			ID:          1,
+			SKU:         "MUG-1",
+			Name:        "Mug",
+			Description: "A mug",
+			Price:       decimal.RequireFromString("10.50"),
+			Quantity:    3,
+			CategoryIDs: []int64{2, 1},
+			Options:     []string{"size"},
+			Status:      ProductDraft,
+			PublishAt:   &publishAt,
+			UnpublishAt: &unpublishAt,
+		}
+		if change != nil {
+			change(p)
+		}
+		return p
+	}
+	allFields := slices.Sorted(maps.Keys(productHistoryFields(&Product{})))
+
+	tests := []struct {
+		name    string
+		before  *Product
+		after   *Product
+		changes map[string][2]string
+	}{
+		{
+			name:   "creation records every field",
+			before: nil,
+			after:  product(nil),
+		},
+		{
+			name:   "deletion records every field",
+			before: product(nil),
+			after:  nil,
+		},
+		{
+			name:   "equal values in another form",
+			before: product(nil),
+			after: product(func(p *Product) {
+				p.Price = decimal.RequireFromString("10.5")
+				p.CategoryIDs = []int64{1, 2}
+				p.PublishAt = &publishAtElsewhere
+			}),
+			changes: map[string][2]string{},
+		},
+		{
+			name:    "nil and empty lists",
+			before:  product(func(p *Product) { p.Options = nil }),
+			after:   product(func(p *Product) { p.Options = []string{} }),
+			changes: map[string][2]string{},
+		},
+		{
+			name:   "changed fields",
+			before: product(nil),
+			after: product(func(p *Product) {
+				p.Name = "Big mug"
+				p.CategoryIDs = []int64{1}
+				p.SetStatus(ProductPublished)
+			}),
+			changes: map[string][2]string{
+				"name":         {`"Mug"`, `"Big mug"`},
+				"category_ids": {`[1,2]`, `[1]`},
+				"status":       {`"draft"`, `"published"`},
+				"publish_at":   {`"2026-01-02T03:04:05Z"`, `null`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		changes, err := diffProducts(tt.before, tt.after)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		// creations and deletions are only checked for their fields, the
+		// product sets every one of them
+		if tt.changes == nil {
+			if got := slices.Sorted(maps.Keys(changes)); !slices.Equal(got, allFields) {
+				t.Errorf("%s: changed fields = %v, want %v", tt.name, got, allFields)
+			}
+			for field, c := range changes {
+				if (tt.before == nil) != (string(c.Before) == "null") || (tt.after == nil) != (string(c.After) == "null") {
+					t.Errorf("%s: %s = %s -> %s", tt.name, field, c.Before, c.After)
+				}
+			}
+			continue
+		}
+		checkFieldChanges(t, tt.name, changes, tt.changes)
+	}
+}
+
+func TestDiffVariantFields(t *testing.T) {
+	price := decimal.RequireFromString("12")
+	variant := ProductVariant{ID: 5, SKU: "MUG-1-L", Options: VariantOptions{"size": "L"}, Quantity: 4}
+	restocked := variant
+	restocked.Price = &price
+	restocked.Quantity = 10
+
+	tests := []struct {
+		name    string
+		before  *ProductVariant
+		after   *ProductVariant
+		changes map[string][2]string
+	}{
+		{
+			name:   "added variant",
+			before: nil,
+			after:  &variant,
+			changes: map[string][2]string{
+				"variants.5.sku":      {`null`, `"MUG-1-L"`},
+				"variants.5.options":  {`null`, `{"size":"L"}`},
+				"variants.5.quantity": {`null`, `4`},
+			},
+		},
+		{
+			name:   "price and stock change",
+			before: &variant,
+			after:  &restocked,
+			changes: map[string][2]string{
+				"variants.5.price":    {`null`, `"12"`},
+				"variants.5.quantity": {`4`, `10`},
+			},
+		},
+		{
+			name:   "removed variant",
+			before: &restocked,
+			after:  nil,
+			changes: map[string][2]string{
+				"variants.5.sku":      {`"MUG-1-L"`, `null`},
+				"variants.5.options":  {`{"size":"L"}`, `null`},
+				"variants.5.price":    {`"12"`, `null`},
+				"variants.5.quantity": {`10`, `null`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		changes, err := diffFields(variantHistoryFields(tt.before), variantHistoryFields(tt.after))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		checkFieldChanges(t, tt.name, changes, tt.changes)
+	}
+}
+
+func checkFieldChanges(t *testing.T, name string, got map[string]FieldChange, want map[string][2]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: changed fields = %v, want %v", name, slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)))
+		return
+	}
+	for field, w := range want {
+		c, ok := got[field]
+		if !ok || string(c.Before) != w[0] || string(c.After) != w[1] {
+			t.Errorf("%s: %s = %s -> %s, want %s -> %s", name, field, c.Before, c.After, w[0], w[1])
+		}
+	}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
+	"image"
 	"io"
 	"log"
 	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/shopspring/decimal"
 	"github.com/stripe/stripe-go/v81"
@@ -60,9 +66,15 @@ func (app *Application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	permissions := []string{"products:read"}
-	u, err := app.storage.CreateUser(req.Name, req.Email, passwordHash, permissions)
+	roles := []string{"customer"}
+	u, err := app.storage.CreateUser(req.Name, req.Email, passwordHash, roles)
 	if err != nil {
+		// Deleted accounts keep their email until they are anonymized.
+		if errors.Is(err, ErrDuplicateEmail) {
+			v.Check(false, "email", ErrDuplicateEmail.Error())
+			writeValidatorErrors(v, w)
+			return
+		}
 		writeServerError(w)
 		return
 	}
@@ -73,17 +85,7 @@ func (app *Application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	app.background(func() {
-		tmpl, err := template.ParseFS(templates, "templates/*.gotmpl")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		err = app.mailer.Send(req.Email, tmpl, map[string]any{"token": token.Text})
-		if err != nil {
-			log.Printf("failed to send email to %s: %v\n", req.Email, err)
-		}
-	})
+	app.sendMail(req.Email, "user_activation_mail.gotmpl", map[string]any{"token": token.Text})
 
 	res := map[string]any{
 		"message": fmt.Sprintf("an activation token was sent to email %s", req.Email),
@@ -117,9 +119,10 @@ func (app *Application) updateUserHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	var req struct {
-		Name     *string `json:"name"`
-		Email    *string `json:"email"`
-		Password *string `json:"password"`
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
 	}
 	if err := readJSON(r, &req); err != nil {
 		writeBadRequest(err, w)
@@ -137,6 +140,9 @@ func (app *Application) updateUserHandler(w http.ResponseWriter, r *http.Request
 	if req.Password != nil {
 		v.CheckPassword(*req.Password)
 	}
+	if req.Email != nil || req.Password != nil {
+		v.Check(req.CurrentPassword != "", "current_password", "must be provided to change the email or password")
+	}
 
 	if v.HasError() {
 		writeValidatorErrors(v, w)
@@ -144,7 +150,8 @@ func (app *Application) updateUserHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	u := getUserFromRequest(r)
-	if u == nil {
+	t := getTokenFromRequest(r)
+	if u == nil || t == nil {
 		writeServerError(w)
 		return
 	}
@@ -154,12 +161,31 @@ func (app *Application) updateUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if req.Email != nil || req.Password != nil {
+		err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(req.CurrentPassword))
+		if err != nil {
+			app.recordFailedLogin(u.Email, u)
+			writeError(errors.New("current password is incorrect"), http.StatusForbidden, w)
+			return
+		}
+	}
+
 	if req.Name != nil {
 		u.Name = *req.Name
 	}
 
-	if req.Email != nil {
-		u.Email = *req.Email
+	// email changes only take effect once the new address is confirmed
+	changeEmail := req.Email != nil && !strings.EqualFold(*req.Email, u.Email)
+	if changeEmail {
+		existing, err := app.storage.GetUserByEmail(*req.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		if existing != nil {
+			writeError(ErrDuplicateEmail, http.StatusConflict, w)
+			return
+		}
 	}
 
 	if req.Password != nil {
@@ -171,13 +197,198 @@ func (app *Application) updateUserHandler(w http.ResponseWriter, r *http.Request
 		u.PasswordHash = passwordHash
 	}
 
-	err = app.storage.UpdateUser(u)
+	if req.Name != nil || req.Password != nil {
+		err = app.storage.UpdateUser(u)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+	res := map[string]any{
+		"user": u,
+	}
+
+	if req.Password != nil {
+		err = app.storage.DeleteOtherSessions(u.ID, t)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		err = app.storage.DeleteTokensForUser(u.ID, ScopePasswordReset)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		data := map[string]any{
+			"name": u.Name,
+			"time": time.Now().UTC().Format(time.RFC1123),
+			"ip":   getClientIP(r),
+		}
+		app.sendMail(u.Email, "password_changed_mail.gotmpl", data)
+	}
+
+	if changeEmail {
+		_, err = app.storage.CreateEmailChange(u, *req.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		err = app.storage.DeleteTokensForUser(u.ID, ScopeEmailChange)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		token, err := app.storage.CreateToken(u.ID, time.Hour, ScopeEmailChange)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		app.sendMail(*req.Email, "email_change_mail.gotmpl", map[string]any{"name": u.Name, "token": token.Text})
+		res["message"] = fmt.Sprintf("a confirmation token was sent to email %s, your email will change once it is confirmed", *req.Email)
+	}
+
+	writeOK(res, w)
+}
+
+func (app *Application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckToken(req.Token)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserFromToken(req.Token, ScopeEmailChange)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeBadRequest(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	change, err := app.storage.GetPendingEmailChange(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if change == nil {
+		writeBadRequest(errors.New("there is no pending email change"), w)
+		return
+	}
+
+	err = app.storage.ConfirmEmailChange(u, change)
+	if err != nil {
+		if errors.Is(err, ErrDuplicateEmail) {
+			writeError(err, http.StatusConflict, w)
+			return
+		}
+		writeServerError(w)
+		return
+	}
+
+	for _, scope := range []TokenScope{ScopeEmailChange, ScopeEmailRevert} {
+		err = app.storage.DeleteTokensForUser(u.ID, scope)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+
+	token, err := app.storage.CreateToken(u.ID, 7*24*time.Hour, ScopeEmailRevert)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
+
+	data := map[string]any{
+		"name":     u.Name,
+		"oldEmail": change.OldEmail,
+		"newEmail": change.NewEmail,
+		"token":    token.Text,
+	}
+	app.sendMail(change.OldEmail, "email_changed_mail.gotmpl", data)
+
 	res := map[string]any{
-		"user": u,
+		"message": "email changed successfully",
+		"user":    u,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) revertEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckToken(req.Token)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserFromToken(req.Token, ScopeEmailRevert)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeBadRequest(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	change, err := app.storage.GetLastConfirmedEmailChange(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if change == nil {
+		writeBadRequest(errors.New("there is no email change to revert"), w)
+		return
+	}
+
+	err = app.storage.RevertEmailChange(u, change)
+	if err != nil {
+		if errors.Is(err, ErrDuplicateEmail) {
+			writeError(err, http.StatusConflict, w)
+			return
+		}
+		writeServerError(w)
+		return
+	}
+
+	// the change may have come from a stolen session, so every session is
+	// revoked, including the signed authentication tokens already issued
+	scopes := []TokenScope{ScopeEmailRevert, ScopeEmailChange}
+	for _, scope := range scopes {
+		err = app.storage.DeleteTokensForUser(u.ID, scope)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+	err = app.storage.DeleteAllSessions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"message": fmt.Sprintf("email reverted to %s and all sessions were revoked, please reset your password", u.Email),
 	}
 	writeOK(res, w)
 }
@@ -197,14 +408,122 @@ func (app *Application) deleteUserHandler(w http.ResponseWriter, r *http.Request
 		writeForbidden(w)
 		return
 	}
-	err = app.storage.DeleteUser(u)
+	deletedAt, err := app.storage.DeleteUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message":        "user deleted successfully, the account can be restored through POST /v1/users/restore until restore_before",
+		"restore_before": deletedAt.Add(app.config.users.deletionGracePeriod),
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckEmail(req.Email)
+	v.CheckPassword(req.Password)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	attempt, ok := app.checkLoginLockout(req.Email, w)
+	if !ok {
+		return
+	}
+
+	u, deletedAt, err := app.storage.GetDeletedUserByEmail(req.Email)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil || time.Since(deletedAt) > app.config.users.deletionGracePeriod {
+		app.recordFailedLogin(req.Email, nil)
+		writeError(errors.New("invalid credentials"), http.StatusUnauthorized, w)
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(req.Password))
+	if err != nil {
+		app.recordFailedLogin(req.Email, nil)
+		writeError(errors.New("invalid credentials"), http.StatusUnauthorized, w)
+		return
+	}
+
+	if attempt != nil {
+		err = app.storage.ClearLoginAttempts(req.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+
+	err = app.storage.RestoreUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "user restored successfully",
+		"user":    u,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	orders, err := app.storage.GetOrdersItems(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if orders == nil {
+		orders = []OrderItems{}
+	}
+	cartItems, err := app.storage.GetCartItems(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	transations, err := app.storage.GetTransations(u.ID)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
+
 	res := map[string]any{
-		"message": "user deleted successfully",
+		"exported_at":  time.Now().UTC(),
+		"user":         u,
+		"orders":       orders,
+		"cart_items":   cartItems,
+		"transactions": transations,
 	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, u.ID))
 	writeOK(res, w)
 }
 
@@ -227,6 +546,11 @@ func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	_, ok := app.checkLoginLockout(req.Email, w)
+	if !ok {
+		return
+	}
+
 	u, err := app.storage.GetUserByEmail(req.Email)
 	if err != nil {
 		writeError(err, http.StatusInternalServerError, w)
@@ -234,269 +558,3144 @@ func (app *Application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if u == nil {
+		app.recordFailedLogin(req.Email, nil)
 		writeError(errors.New("invalid credentials"), http.StatusUnauthorized, w)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(req.Password))
 	if err != nil {
+		app.recordFailedLogin(req.Email, u)
 		writeError(errors.New("invalid credentials"), http.StatusUnauthorized, w)
 		return
 	}
 
-	token, err := app.storage.CreateToken(u.ID, 24*time.Hour, ScopeAuthentication)
+	app.completeLogin(u, w, r)
+}
+
+// completeLogin issues the session tokens of a user who passed the first
+// authentication step, or an mfa token when a second factor is required.
+// Failed logins are only cleared once the session tokens are issued, so a
+// correct password does not reset the failed codes of the second step.
+func (app *Application) completeLogin(u *User, w http.ResponseWriter, r *http.Request) {
+	if u.SuspendedAt != nil {
+		writeError(ErrUserSuspended, http.StatusForbidden, w)
+		return
+	}
+
+	totp, err := app.storage.GetTOTP(u.ID)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
+	if totp != nil && totp.IsEnabled {
+		token, err := app.storage.CreateToken(u.ID, 5*time.Minute, ScopeMFA)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		res := map[string]any{
+			"mfa_required": true,
+			"mfa_token":    token,
+		}
+		writeOK(res, w)
+		return
+	}
+
+	err = app.storage.ClearLoginAttempts(u.Email)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	app.writeSessionTokens(u, w, r)
+}
+
+// checkLoginLockout rejects the request with 429 while the account has to wait
+// before its next attempt. The attempt is nil when no failure is recorded.
+func (app *Application) checkLoginLockout(email string, w http.ResponseWriter) (*LoginAttempt, bool) {
+	attempt, err := app.storage.GetLoginAttempt(email)
+	if err != nil {
+		writeServerError(w)
+		return nil, false
+	}
+	if attempt != nil {
+		wait := attempt.RetryAfter(app.config.lockout.freeFailures, app.config.lockout.maxDelay)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests, w)
+			return nil, false
+		}
+	}
+	return attempt, true
+}
+
+// recordFailedLogin counts the failure against the email even when no account
+// exists, so responses do not reveal which emails are registered. It reports
+// whether the failure locked the account.
+func (app *Application) recordFailedLogin(email string, u *User) bool {
+	a, err := app.storage.RecordFailedLogin(email, app.config.lockout.maxFailures, app.config.lockout.duration)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	locked := a.Failures == 0 && a.LockedUntil.After(time.Now())
+	if u != nil && locked {
+		data := map[string]any{
+			"name":  u.Name,
+			"until": a.LockedUntil.UTC().Format(time.RFC1123),
+		}
+		app.sendMail(u.Email, "account_locked_mail.gotmpl", data)
+	}
+	return locked
+}
+
+func (app *Application) writeSessionTokens(u *User, w http.ResponseWriter, r *http.Request) {
+	access, refresh, err := app.storage.CreateTokenPair(u.ID, r.UserAgent(), getClientIP(r), app.config.tokens.authenticationTTL, app.config.tokens.refreshTTL)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	err = app.issueAccessToken(access)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"authentication_token": access,
+		"refresh_token":        refresh,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+// issueAccessToken replaces the text of the authentication token with a signed
+// JWT when the API is configured to issue them. The permissions are captured
+// at issue time, so changes only apply once the token is refreshed.
+func (app *Application) issueAccessToken(access *Token) error {
+	if app.jwt == nil {
+		return nil
+	}
+	u, err := app.storage.GetUserById(access.UserID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errors.New("user not found")
+	}
+	permissions, err := app.storage.GetUserPermissions(u.ID)
+	if err != nil {
+		return err
+	}
+	claims := &AccessClaims{
+		Subject:     strconv.FormatInt(u.ID, 10),
+		ExpiresAt:   access.ExpiresAt.Unix(),
+		SessionID:   access.FamilyID,
+		IsActivated: u.IsActivated,
+		Permissions: permissions,
+	}
+	text, err := app.jwt.Sign(claims)
+	if err != nil {
+		return err
+	}
+	access.Text = text
+	return nil
+}
+
+// verifySecondFactor accepts either a TOTP code or one of the unused recovery
+// codes of the user.
+func (app *Application) verifySecondFactor(totp *TOTP, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.storage.UseRecoveryCode(totp.UserID, recoveryCode)
+	}
+	step, ok := validateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.storage.UseTOTPStep(totp.UserID, step)
+}
+
+func (app *Application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token        string `json:"token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckToken(req.Token)
+	v.Check(req.Code != "" || req.RecoveryCode != "", "code", "code or recovery_code must be provided")
+	if req.RecoveryCode == "" {
+		v.CheckTOTPCode(req.Code)
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserFromToken(req.Token, ScopeMFA)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeError(errors.New("invalid or expired mfa token"), http.StatusUnauthorized, w)
+		return
+	}
+
+	// Wrong codes count against the same lockout as wrong passwords, so the
+	// code cannot be guessed within the lifetime of the mfa token.
+	attempt, ok := app.checkLoginLockout(u.Email, w)
+	if !ok {
+		return
+	}
+
+	totp, err := app.storage.GetTOTP(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if totp == nil || !totp.IsEnabled {
+		writeError(errors.New("two-factor authentication is not enabled"), http.StatusConflict, w)
+		return
+	}
+
+	ok, err = app.verifySecondFactor(totp, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if !ok {
+		// A lockout also ends the mfa session, the password has to be
+		// entered again once it expires.
+		if app.recordFailedLogin(u.Email, u) {
+			err = app.storage.DeleteTokensForUser(u.ID, ScopeMFA)
+			if err != nil {
+				writeServerError(w)
+				return
+			}
+		}
+		writeError(errors.New("invalid two-factor authentication code"), http.StatusUnauthorized, w)
+		return
+	}
+
+	err = app.storage.DeleteTokensForUser(u.ID, ScopeMFA)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	if attempt != nil {
+		err = app.storage.ClearLoginAttempts(u.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+
+	if u.SuspendedAt != nil {
+		writeError(ErrUserSuspended, http.StatusForbidden, w)
+		return
+	}
+
+	app.writeSessionTokens(u, w, r)
+}
+
+func (app *Application) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	keys, err := app.storage.GetAPIKeys(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"api_keys": keys,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	var req struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	known, err := app.storage.GetAllPermissions()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	granted, err := app.storage.GetUserPermissions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(req.Name != "", "name", "must be provided")
+	v.Check(len(req.Name) <= 100, "name", "must not be more than 100 characters")
+	v.CheckPermissions(req.Permissions, known)
+	for _, code := range req.Permissions {
+		// a key can never do more than its owner
+		v.Check(!known.Has(code) || granted.Has(code), "permissions", fmt.Sprintf("you do not have permission %q", code))
+	}
+	if req.ExpiresAt != nil {
+		v.Check(req.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	slices.Sort(req.Permissions)
+	key, err := app.storage.CreateAPIKey(u.ID, req.Name, slices.Compact(req.Permissions), req.ExpiresAt)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"api_key": key,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	keyID, err := getPathValuePositiveInt(r, "key_id")
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	found, err := app.storage.DeleteAPIKey(u.ID, int64(keyID))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if !found {
+		writeNotFound(w)
+		return
+	}
+
+	res := map[string]any{
+		"message": "api key revoked successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	totp, err := app.storage.GetTOTP(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if totp != nil && totp.IsEnabled {
+		writeError(errors.New("two-factor authentication is already enabled"), http.StatusConflict, w)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	err = app.storage.SetTOTPSecret(u.ID, secret)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"secret": secret,
+		"uri":    totpURI(u.Email, secret),
+		"message": "add the secret to your authenticator app and confirm it with a code " +
+			"through PUT /v1/users/{id}/totp",
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) enableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckTOTPCode(req.Code)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	totp, err := app.storage.GetTOTP(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if totp == nil {
+		writeError(errors.New("two-factor authentication enrollment was not started"), http.StatusConflict, w)
+		return
+	}
+	if totp.IsEnabled {
+		writeError(errors.New("two-factor authentication is already enabled"), http.StatusConflict, w)
+		return
+	}
+
+	step, ok := validateTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		writeBadRequest(errors.New("invalid two-factor authentication code"), w)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	err = app.storage.EnableTOTP(u.ID, step, hashes)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"message":        "two-factor authentication enabled, store the recovery codes in a safe place",
+		"recovery_codes": codes,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(req.Code != "" || req.RecoveryCode != "", "code", "code or recovery_code must be provided")
+	if req.RecoveryCode == "" {
+		v.CheckTOTPCode(req.Code)
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	totp, err := app.storage.GetTOTP(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if totp == nil || !totp.IsEnabled {
+		writeError(errors.New("two-factor authentication is not enabled"), http.StatusConflict, w)
+		return
+	}
+
+	// a stolen session must not be able to guess the code
+	attempt, ok := app.checkLoginLockout(u.Email, w)
+	if !ok {
+		return
+	}
+
+	ok, err = app.verifySecondFactor(totp, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if !ok {
+		app.recordFailedLogin(u.Email, u)
+		writeBadRequest(errors.New("invalid two-factor authentication code"), w)
+		return
+	}
+
+	if attempt != nil {
+		err = app.storage.ClearLoginAttempts(u.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+	}
+
+	err = app.storage.DeleteTOTP(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"message": "two-factor authentication disabled",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckToken(req.Token)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	access, refresh, err := app.storage.RotateRefreshToken(req.Token, r.UserAgent(), getClientIP(r), app.config.tokens.authenticationTTL, app.config.tokens.refreshTTL)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			writeError(errors.New("refresh token was already used, all tokens of this session were revoked"), http.StatusUnauthorized, w)
+			return
+		}
+		writeServerError(w)
+		return
+	}
+	if access == nil {
+		writeError(errors.New("invalid or expired refresh token"), http.StatusUnauthorized, w)
+		return
+	}
+	err = app.issueAccessToken(access)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"authentication_token": access,
+		"refresh_token":        refresh,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	u := getUserFromRequest(r)
+	t := getTokenFromRequest(r)
+	if u == nil || t == nil {
+		writeServerError(w)
+		return
+	}
+
+	var err error
+	if t.FamilyID != 0 {
+		_, err = app.storage.DeleteSession(u.ID, t.FamilyID)
+	} else {
+		err = app.storage.DeleteToken(t)
+	}
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if t.FamilyID != 0 {
+		app.revoked.Add(t.FamilyID, time.Now().Add(app.config.tokens.authenticationTTL))
+	}
+
+	res := map[string]any{
+		"message": "logged out successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	t := getTokenFromRequest(r)
+	if u == nil || t == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	sessions, err := app.storage.GetSessions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == t.FamilyID
+	}
+
+	res := map[string]any{
+		"sessions": sessions,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	sessionID, err := getPathValuePositiveInt(r, "session_id")
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	found, err := app.storage.DeleteSession(u.ID, int64(sessionID))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if !found {
+		writeNotFound(w)
+		return
+	}
+	app.revoked.Add(int64(sessionID), time.Now().Add(app.config.tokens.authenticationTTL))
+
+	res := map[string]any{
+		"message": "session revoked successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := getUserFromRequest(r)
+	t := getTokenFromRequest(r)
+	if u == nil || t == nil {
+		writeServerError(w)
+		return
+	}
+	if u.ID != int64(id) {
+		writeForbidden(w)
+		return
+	}
+
+	err = app.storage.DeleteOtherSessions(u.ID, t)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"message": "all other sessions were revoked successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getIdentityProvider(w http.ResponseWriter, r *http.Request) (string, IdentityProvider) {
+	name := r.PathValue("provider")
+	provider, ok := app.identityProviders[name]
+	if !ok {
+		writeNotFound(w)
+		return "", nil
+	}
+	return name, provider
+}
+
+func (app *Application) oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider := app.getIdentityProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	state, err := randomURLString(32)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	st := &OAuthState{
+		State:        state,
+		Provider:     name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(10 * time.Minute),
+	}
+	err = app.storage.CreateOAuthState(st)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, pkceChallenge(verifier))
+	if err != nil {
+		log.Printf("identity provider %s: %v\n", name, err)
+		writeError(errors.New("identity provider is unavailable"), http.StatusBadGateway, w)
+		return
+	}
+
+	res := map[string]any{
+		"url": authURL,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider := app.getIdentityProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeBadRequest(fmt.Errorf("identity provider returned an error: %s %s", e, query.Get("error_description")), w)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(query.Get("state") != "", "state", "must be provided")
+	v.Check(query.Get("code") != "", "code", "must be provided")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	st, err := app.storage.ConsumeOAuthState(query.Get("state"), name)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if st == nil {
+		writeBadRequest(errors.New("invalid or expired state"), w)
+		return
+	}
+
+	identity, err := provider.Authenticate(r.Context(), query.Get("code"), st.CodeVerifier, st.Nonce)
+	if err != nil {
+		log.Printf("identity provider %s: %v\n", name, err)
+		writeError(errors.New("could not verify the identity with the provider"), http.StatusUnauthorized, w)
+		return
+	}
+
+	u, err := app.storage.GetUserByIdentity(identity.Provider, identity.Subject)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	if u == nil {
+		if !identity.canLinkByEmail() {
+			writeError(errors.New("the identity provider did not verify your email address"), http.StatusForbidden, w)
+			return
+		}
+
+		u, err = app.storage.GetUserByEmail(identity.Email)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+
+		if u != nil {
+			err = app.storage.LinkIdentity(u, identity)
+		} else {
+			userName := identity.Name
+			if userName == "" {
+				userName, _, _ = strings.Cut(identity.Email, "@")
+			}
+			if utf8.RuneCountInString(userName) > 50 {
+				userName = string([]rune(userName)[:50])
+			}
+			u, err = app.storage.CreateUserWithIdentity(userName, identity, []string{"customer"})
+		}
+		if err != nil {
+			if errors.Is(err, ErrDuplicateEmail) || isUniqueViolation(err) {
+				writeError(errors.New("this identity is already linked to an account"), http.StatusConflict, w)
+				return
+			}
+			writeServerError(w)
+			return
+		}
+	}
+
+	app.completeLogin(u, w, r)
+}
+
+func (app *Application) createUserActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	err := readJSON(r, &req)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckEmail(req.Email)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserByEmail(req.Email)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	if u == nil {
+		writeBadRequest(errors.New("invalid email"), w)
+		return
+	}
+
+	if u.IsActivated {
+		writeError(errors.New("user is already activated"), http.StatusConflict, w)
+		return
+	}
+
+	token, err := app.storage.CreateToken(u.ID, 5*time.Minute, ScopeActivation)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	app.sendMail(req.Email, "user_activation_mail.gotmpl", map[string]any{"token": token.Text})
+
+	res := map[string]any{
+		"message": fmt.Sprintf("an activation token was sent to email %s", req.Email),
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u, err := app.storage.GetUserFromToken(req.Token, ScopeActivation)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeBadRequest(errors.New("invalid token"), w)
+		return
+	}
+	u.IsActivated = true
+	err = app.storage.UpdateUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "user activated",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	err := readJSON(r, &req)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckEmail(req.Email)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserByEmail(req.Email)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	// the response is the same whether the account exists or not, so it
+	// cannot be used to find out which emails have an account
+	if u != nil && u.IsActivated {
+		err = app.storage.DeleteTokensForUser(u.ID, ScopePasswordReset)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+
+		token, err := app.storage.CreateToken(u.ID, 45*time.Minute, ScopePasswordReset)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+
+		app.sendMail(u.Email, "password_reset_mail.gotmpl", map[string]any{"token": token.Text})
+	}
+
+	res := map[string]any{
+		"message": "if the account exists an email was sent with a password reset token",
+	}
+	writeJSON(res, http.StatusOK, w)
+}
+
+func (app *Application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckPassword(req.Password)
+	v.CheckToken(req.Token)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u, err := app.storage.GetUserFromToken(req.Token, ScopePasswordReset)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeBadRequest(errors.New("invalid or expired password reset token"), w)
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	u.PasswordHash = passwordHash
+
+	err = app.storage.UpdateUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	err = app.storage.DeleteTokensForUser(u.ID, ScopePasswordReset)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	// signed authentication tokens stay valid until their session is revoked
+	err = app.storage.DeleteAllSessions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	res := map[string]any{
+		"message": "your password was reset successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.storage.GetRoles()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"roles": roles,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	known, err := app.storage.GetAllPermissions()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(req.Name != "", "name", "must be provided")
+	v.Check(len(req.Name) <= 50, "name", "must not be more than 50 characters")
+	v.CheckPermissions(req.Permissions, known)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	role, err := app.storage.CreateRole(req.Name, req.Permissions)
+	if err != nil {
+		if errors.Is(err, ErrDuplicateRole) {
+			writeError(err, http.StatusConflict, w)
+			return
+		}
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"role": role,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	role, err := app.storage.GetRoleByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if role == nil {
+		writeNotFound(w)
+		return
+	}
+	err = app.storage.DeleteRole(role)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "resource deleted successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getUserFromPathValue(w http.ResponseWriter, r *http.Request) *User {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return nil
+	}
+	u, err := app.storage.GetUserById(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return nil
+	}
+	if u == nil {
+		writeNotFound(w)
+		return nil
+	}
+	return u
+}
+
+func (app *Application) getUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	roles, err := app.storage.GetUserRoles(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	permissions, err := app.storage.GetUserPermissions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if permissions == nil {
+		permissions = Permissions{}
+	}
+	res := map[string]any{
+		"roles":       roles,
+		"permissions": permissions,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) assignUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoleID int64 `json:"role_id"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.Check(req.RoleID > 0, "role_id", "must be greater than zero")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	role, err := app.storage.GetRoleByID(req.RoleID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if role == nil {
+		writeNotFound(w)
+		return
+	}
+	err = app.storage.AssignRole(u.ID, role.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": fmt.Sprintf("role %q assigned to user %d", role.Name, u.ID),
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) revokeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	roleID, err := getPathValuePositiveInt(r, "role_id")
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	found, err := app.storage.RevokeRole(u.ID, int64(roleID))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if !found {
+		writeNotFound(w)
+		return
+	}
+	res := map[string]any{
+		"message": "role revoked successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	known, err := app.storage.GetAllPermissions()
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckPermissions(req.Permissions, known)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	err = app.storage.GrantPermissions(u.ID, req.Permissions...)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "permissions granted successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	err := app.storage.RevokePermissions(u.ID, code)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "permission revoked successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	err := app.storage.ClearLoginAttempts(u.Email)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": fmt.Sprintf("user %d unlocked", u.ID),
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := UserFilter{
+		Email:    query.Get("email"),
+		Sort:     query.Get("sort"),
+		Page:     1,
+		PageSize: 20,
+	}
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+
+	for param, dst := range map[string]**bool{"activated": &f.IsActivated, "suspended": &f.IsSuspended} {
+		str := query.Get(param)
+		if str == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(str)
+		if err != nil {
+			writeBadRequest(fmt.Errorf("%s: must be a boolean", param), w)
+			return
+		}
+		*dst = &v
+	}
+
+	for param, dst := range map[string]**time.Time{"created_after": &f.CreatedAfter, "created_before": &f.CreatedBefore} {
+		str := query.Get(param)
+		if str == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			writeBadRequest(fmt.Errorf("%s: must be an RFC 3339 timestamp", param), w)
+			return
+		}
+		*dst = &v
+	}
+
+	for param, dst := range map[string]*int{"page": &f.Page, "page_size": &f.PageSize} {
+		str := query.Get(param)
+		if str == "" {
+			continue
+		}
+		v, err := strconv.Atoi(str)
+		if err != nil {
+			writeBadRequest(fmt.Errorf("%s: must be an integer", param), w)
+			return
+		}
+		*dst = v
+	}
+
+	v := NewValidator()
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be less than or equal to 10_000_000")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be less than or equal to 100")
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedBefore.After(*f.CreatedAfter), "created_before", `must be later than "created_after"`)
+	}
+	sortOptions := []string{"id", "-id", "name", "-name", "email", "-email", "created_at", "-created_at", "balance", "-balance"}
+	v.Check(slices.Index(sortOptions, f.Sort) != -1, "sort", "search option is not supported")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	users, total, err := app.storage.GetUsers(f)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"users": users,
+		"total": total,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	orders, err := app.storage.GetOrdersItems(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if orders == nil {
+		orders = []OrderItems{}
+	}
+	roles, err := app.storage.GetUserRoles(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"user":   u,
+		"roles":  roles,
+		"orders": orders,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	if u.ID == getUserFromRequest(r).ID {
+		writeError(errors.New("you cannot suspend your own account"), http.StatusConflict, w)
+		return
+	}
+	if u.SuspendedAt != nil {
+		writeError(errors.New("user is already suspended"), http.StatusConflict, w)
+		return
+	}
+	err := app.storage.SuspendUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"user": u,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) unsuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	if u.SuspendedAt == nil {
+		writeError(errors.New("user is not suspended"), http.StatusConflict, w)
+		return
+	}
+	err := app.storage.UnsuspendUser(u)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"user": u,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserFromPathValue(w, r)
+	if u == nil {
+		return
+	}
+	err := app.storage.DeleteAllSessions(u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": fmt.Sprintf("user %d signed out of all sessions", u.ID),
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createProductHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SKU         string          `json:"sku"`
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Price       decimal.Decimal `json:"price"`
+		Quantity    int64           `json:"quantity"`
+		CategoryIDs []int64         `json:"category_ids"`
+		Options     []string        `json:"options"`
+		Status      ProductStatus   `json:"status"`
+		PublishAt   *time.Time      `json:"publish_at"`
+		UnpublishAt *time.Time      `json:"unpublish_at"`
+	}
+
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	if req.Status == "" {
+		req.Status = ProductDraft
+	}
+
+	v := NewValidator()
+	v.Check(req.Name != "", "name", "must be provided")
+	v.Check(len(req.Name) <= 50, "name", "must not be more than 50 characters")
+	v.Check(req.Description != "", "description", "must be provided")
+	v.Check(req.Price.GreaterThan(decimal.NewFromInt(0)), "price", "must be greater than zero")
+	v.Check(req.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	v.Check(len(req.SKU) <= 64, "sku", "must not be more than 64 characters")
+	v.CheckProductOptions(req.Options)
+	v.CheckProductSchedule(req.Status, req.PublishAt, req.UnpublishAt)
+
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	p := &Product{
+		SKU:         req.SKU,
+		Name:        req.Name,
+		Description: req.Description,
+		Price:       req.Price,
+		Quantity:    req.Quantity,
+		CategoryIDs: req.CategoryIDs,
+		Options:     req.Options,
+		Status:      req.Status,
+		PublishAt:   req.PublishAt,
+		UnpublishAt: req.UnpublishAt,
+	}
+	err := app.storage.CreateProduct(p, u.ID)
+	if err != nil {
+		writeProductError(err, w)
+		return
+	}
+	res := map[string]any{
+		"product": p,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+// getProductHistoryHandler lists the changes of a product, newest first by
+// default. The history of a deleted product can still be read.
+func (app *Application) getProductHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "-id"
+	}
+	pageSize := 20
+	pageSizeStr := query.Get("page_size")
+	if pageSizeStr != "" {
+		v, err := strconv.Atoi(pageSizeStr)
+		if err != nil {
+			writeBadRequest(err, w)
+			return
+		}
+		pageSize = v
+	}
+
+	v := NewValidator()
+	v.Check(sort == "id" || sort == "-id", "sort", "search option is not supported")
+	v.Check(pageSize > 0, "page_size", "must be greater than zero")
+	v.Check(pageSize <= 100, "page_size", "must be less than or equal to 100")
+	var c *Cursor
+	cursor := query.Get("cursor")
+	if cursor != "" {
+		c, err = DecodeCursor(cursor)
+		v.Check(err == nil, "cursor", "must be valid")
+		v.Check(err != nil || c.Sort == sort, "cursor", `must be used with the "sort" it was issued for`)
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	changes, pagination, err := app.storage.GetProductChanges(int64(id), sort, c, pageSize)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	// products created before the history was recorded have none
+	if len(changes) == 0 && c == nil {
+		p, err := app.storage.GetProductByID(int64(id))
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		if p == nil {
+			writeNotFound(w)
+			return
+		}
+	}
+	res := map[string]any{
+		"history":  changes,
+		"metadata": pagination,
+	}
+	writeOK(res, w)
+}
+
+// writeProductError reports the storage errors caused by the request itself.
+func writeProductError(err error, w http.ResponseWriter) {
+	v := NewValidator()
+	switch {
+	case errors.Is(err, ErrUnknownCategory):
+		v.Check(false, "category_ids", "must only contain existing categories")
+	case errors.Is(err, ErrDuplicateProductSKU):
+		v.Check(false, "sku", "a product with this sku already exists")
+	default:
+		writeServerError(w)
+		return
+	}
+	writeValidatorErrors(v, w)
+}
+
+// importProductsHandler starts a background import of the CSV or NDJSON file
+// in the body. The format comes from the format parameter or the content type.
+func (app *Application) importProductsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		for f, ct := range productFormats {
+			if ct == contentType {
+				format = f
+			}
+		}
+	}
+	dryRun := false
+	dryRunStr := query.Get("dry_run")
+	if dryRunStr != "" {
+		v, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			writeBadRequest(errors.New("dry_run: must be a boolean"), w)
+			return
+		}
+		dryRun = v
+	}
+
+	v := NewValidator()
+	_, ok := productFormats[format]
+	v.Check(ok, "format", `must be "csv" or "ndjson", or be given by a "text/csv" or "application/x-ndjson" content type`)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxProductImportSize)
+	rows, err := readProductImportRows(format, r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(fmt.Errorf("body must not be larger than %d bytes", maxProductImportSize), http.StatusRequestEntityTooLarge, w)
+			return
+		}
+		writeBadRequest(err, w)
+		return
+	}
+	v.Check(len(rows) > 0, "body", "must contain at least one row")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	pi := &ProductImport{
+		UserID:    u.ID,
+		Format:    format,
+		DryRun:    dryRun,
+		Status:    ImportPending,
+		TotalRows: len(rows),
+	}
+	err = app.storage.CreateProductImport(pi)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	// the import goes on updating pi, the response gets a copy
+	res := map[string]any{
+		"import": *pi,
+	}
+	app.background(func() {
+		app.runProductImport(pi, rows)
+	})
+	w.Header().Set("Location", fmt.Sprintf("/v1/product-imports/%d", pi.ID))
+	writeJSON(res, http.StatusAccepted, w)
+}
+
+func (app *Application) getProductImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	pi, err := app.storage.GetProductImportByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if pi == nil {
+		writeNotFound(w)
+		return
+	}
+	res := map[string]any{
+		"import": pi,
+	}
+	writeOK(res, w)
+}
+
+// exportProductsHandler streams the whole catalog as CSV or NDJSON, in the
+// format read by importProductsHandler.
+func (app *Application) exportProductsHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := productFormats[format]
+	if !ok {
+		writeBadRequest(errors.New(`format: must be "csv" or "ndjson"`), w)
+		return
+	}
+
+	// a large catalog takes longer to send than the server write timeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Now().Add(5 * time.Minute))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeServerError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+	pw, err := newProductWriter(format, w)
+	if err == nil {
+		err = app.storage.ExportProducts(pw.Write)
+	}
+	if err == nil {
+		err = pw.Flush()
+	}
+	if err != nil {
+		// the status was sent with the first rows, the client only gets a
+		// truncated body
+		log.Printf("product export: %v\n", err)
+	}
+}
+
+// visibleProductStatus returns the status the products shown to the request
+// are limited to, users with products:read see every product and the others
+// only the published ones.
+func (app *Application) visibleProductStatus(r *http.Request) (ProductStatus, error) {
+	ok, err := app.hasPermission(r, "products:read")
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return "", nil
+	}
+	return ProductPublished, nil
+}
+
+// getVisibleProductFromPathValue is getProductFromPathValue for public routes,
+// products the request may not see are not found.
+func (app *Application) getVisibleProductFromPathValue(w http.ResponseWriter, r *http.Request) *Product {
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return nil
+	}
+	ok, err := app.isProductVisible(r, p)
+	if err != nil {
+		writeServerError(w)
+		return nil
+	}
+	if !ok {
+		writeNotFound(w)
+		return nil
+	}
+	return p
+}
+
+// isProductVisible tells whether the request may see the product.
+func (app *Application) isProductVisible(r *http.Request, p *Product) (bool, error) {
+	status, err := app.visibleProductStatus(r)
+	if err != nil {
+		return false, err
+	}
+	return status == "" || p.Status == status, nil
+}
+
+func (app *Application) getProductHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.getVisibleProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+	app.setImageURLs(p)
+	res := map[string]any{
+		"product": p,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getProductsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := ProductFilter{
+		Query:       query.Get("q"),
+		Name:        query.Get("name"),
+		Description: query.Get("description"),
+		Sort:        query.Get("sort"),
+		MinPrice:    decimal.Zero,
+		MaxPrice:    decimal.NewFromFloat(math.MaxFloat64),
+		Page:        1,
+		PageSize:    5,
+	}
+	if f.Sort == "" {
+		f.Sort = "id"
+		if f.Query != "" {
+			f.Sort = "relevance"
+		}
+	}
+
+	minPriceStr := query.Get("min_price")
+	if minPriceStr != "" {
+		v, err := decimal.NewFromString(minPriceStr)
+		if err != nil {
+			writeError(err, http.StatusBadRequest, w)
+			return
+		}
+		f.MinPrice = v
+	}
+
+	maxPriceStr := query.Get("max_price")
+	if maxPriceStr != "" {
+		v, err := decimal.NewFromString(maxPriceStr)
+		if err != nil {
+			writeError(err, http.StatusBadRequest, w)
+			return
+		}
+		f.MaxPrice = v
+	}
+
+	inStockStr := query.Get("in_stock")
+	if inStockStr != "" {
+		v, err := strconv.ParseBool(inStockStr)
+		if err != nil {
+			writeError(err, http.StatusBadRequest, w)
+			return
+		}
+		f.InStock = &v
+	}
+
+	// pages are read by offset unless a cursor is given, an empty one reads
+	// the first page
+	pageStr := query.Get("page")
+	if pageStr != "" {
+		v, err := strconv.Atoi(pageStr)
+		if err != nil {
+			writeError(err, http.StatusBadRequest, w)
+			return
+		}
+		if v <= 0 {
+			writeBadRequest(errors.New("page: must be greater than zero"), w)
+			return
+		}
+		f.Page = v
+	}
+	pageSizeStr := query.Get("page_size")
+	if pageSizeStr != "" {
+		v, err := strconv.Atoi(pageSizeStr)
+		if err != nil {
+			writeError(err, http.StatusBadRequest, w)
+			return
+		}
+		f.PageSize = v
+	}
+
+	v := NewValidator()
+
+	status, err := app.visibleProductStatus(r)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	f.Status = ProductStatus(query.Get("status"))
+	if status != "" {
+		v.Check(f.Status == "" || f.Status == status, "status", "only published products can be listed")
+		f.Status = status
+	} else if f.Status != "" {
+		v.Check(slices.Index(productStatuses, f.Status) != -1, "status", `must be one of "draft", "published" or "archived"`)
+	}
+
+	if query.Has("cursor") {
+		v.Check(pageStr == "", "cursor", `must not be used with "page"`)
+		f.Page = 0
+		cursor := query.Get("cursor")
+		if cursor != "" {
+			c, err := DecodeCursor(cursor)
+			v.Check(err == nil, "cursor", "must be valid")
+			v.Check(err != nil || productSortKeys[strings.TrimPrefix(c.Sort, "-")].validKey(c.Key), "cursor", "must be valid")
+			v.Check(err != nil || c.Sort == f.Sort, "cursor", `must be used with the "sort" it was issued for`)
+			f.Cursor = c
+		}
+	}
+
+	attributes, err := app.parseAttributeFilters(query, v)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	f.Attributes = attributes
+
+	// the category can be given by id or by slug
+	category := query.Get("category")
+	if category != "" {
+		var c *Category
+		var err error
+		if id, convErr := strconv.ParseInt(category, 10, 64); convErr == nil {
+			c, err = app.storage.GetCategoryByID(id)
+		} else {
+			c, err = app.storage.GetCategoryBySlug(category)
+		}
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		v.Check(c != nil, "category", "does not exist")
+		if c != nil {
+			f.CategoryID = c.ID
+		}
+	}
+
+	v.Check(f.MinPrice.GreaterThanOrEqual(decimal.Zero), "min_price", "must be greater than zero or equal zero")
+	v.Check(f.MaxPrice.GreaterThanOrEqual(decimal.Zero), "max_price", "must be greater than zero or equal zero")
+	v.Check(f.MaxPrice.GreaterThanOrEqual(f.MinPrice), "max_price", `must be greater than or equal "min_price"`)
+	v.Check(f.Page <= 10_000_000, "page", "must be less than or equal to 10_000_000")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be less than or equal to 100")
+	sortOptions := []string{"id", "-id", "name", "-name", "created_at", "-created_at", "price", "-price", "relevance"}
+	v.Check(slices.Index(sortOptions, f.Sort) != -1, f.Sort, "search option is not supported")
+	v.Check(f.Sort != "relevance" || f.Query != "", "sort", `"relevance" requires "q"`)
+	v.Check(len(f.Query) <= 200, "q", "must not be more than 200 characters")
+
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	products, pagination, err := app.storage.GetProducts(f)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	for i := range products {
+		app.setImageURLs(&products[i])
+	}
+	facets, err := app.storage.GetProductFacets(f)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"product":  products,
+		"facets":   facets,
+		"metadata": pagination,
+	}
+	if pagination.Total != nil {
+		res["total"] = *pagination.Total
+	}
+
+	// offer a corrected search when a misspelled one found nothing
+	text := f.Query
+	if text == "" {
+		text = f.Name
+	}
+	if len(products) == 0 && f.Cursor == nil && text != "" {
+		didYouMean, err := app.storage.GetDidYouMean(searchWords(text))
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		if didYouMean != "" {
+			res["did_you_mean"] = didYouMean
+		}
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) suggestProductsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	text := query.Get("q")
+	limit := 10
+	limitStr := query.Get("limit")
+	if limitStr != "" {
+		v, err := strconv.Atoi(limitStr)
+		if err != nil {
+			writeBadRequest(err, w)
+			return
+		}
+		limit = v
+	}
+
+	words := searchWords(text)
+	v := NewValidator()
+	v.Check(len(words) > 0, "q", "must contain at least one letter or digit")
+	v.Check(len(text) <= 200, "q", "must not be more than 200 characters")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 25, "limit", "must be less than or equal to 25")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	status, err := app.visibleProductStatus(r)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	completions, err := app.storage.GetProductCompletions(words, status, limit)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	matches, err := app.storage.GetFuzzyProductMatches(strings.Join(words, " "), status, limit)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"completions": completions,
+		"matches":     matches,
+	}
+	if len(completions) == 0 && len(matches) == 0 {
+		didYouMean, err := app.storage.GetDidYouMean(words)
+		if err != nil {
+			writeServerError(w)
+			return
+		}
+		if didYouMean != "" {
+			res["did_you_mean"] = didYouMean
+		}
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	var req struct {
+		SKU         *string          `json:"sku"`
+		Name        *string          `json:"name"`
+		Description *string          `json:"description"`
+		Price       *decimal.Decimal `json:"price"`
+		Quantity    *int64           `json:"quantity"`
+		CategoryIDs *[]int64         `json:"category_ids"`
+		Options     *[]string        `json:"options"`
+		Status      *ProductStatus   `json:"status"`
+		// PublishAt and UnpublishAt are pointers to pointers so that an
+		// explicit null cancels the schedule.
+		PublishAt   **time.Time `json:"publish_at"`
+		UnpublishAt **time.Time `json:"unpublish_at"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(err, http.StatusBadRequest, w)
+		return
+	}
+
+	v := NewValidator()
+	if req.SKU != nil {
+		v.Check(len(*req.SKU) <= 64, "sku", "must not be more than 64 characters")
+	}
+	if req.Name != nil {
+		v.Check(*req.Name != "", "name", "must be provided")
+		v.Check(len(*req.Name) <= 50, "name", "must not be more than 50 characters")
+	}
+	if req.Description != nil {
+		v.Check(*req.Description != "", "description", "must be provided")
+	}
+	if req.Price != nil {
+		v.Check(req.Price.GreaterThan(decimal.NewFromInt(0)), "price", "must be greater than zero")
+	}
+	if req.Quantity != nil {
+		v.Check(*req.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	}
+	if req.Options != nil {
+		v.CheckProductOptions(*req.Options)
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	p, err := app.storage.GetProductByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if p == nil {
+		writeNotFound(w)
+		return
+	}
+	if req.SKU != nil {
+		p.SKU = *req.SKU
+	}
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.Price != nil {
+		p.Price = *req.Price
+	}
+	if req.Quantity != nil {
+		p.Quantity = *req.Quantity
+	}
+	if req.CategoryIDs != nil {
+		p.CategoryIDs = *req.CategoryIDs
+		if p.CategoryIDs == nil {
+			p.CategoryIDs = []int64{}
+		}
+	}
+	if req.Options != nil {
+		options := *req.Options
+		if options == nil {
+			options = []string{}
+		}
+		v.Check(len(p.Variants) == 0 || slices.Equal(p.Options, options), "options", "cannot be changed while the product has variants")
+		if v.HasError() {
+			writeValidatorErrors(v, w)
+			return
+		}
+		p.Options = options
+	}
+	if req.Status != nil {
+		p.SetStatus(*req.Status)
+	}
+	if req.PublishAt != nil {
+		p.PublishAt = *req.PublishAt
+	}
+	if req.UnpublishAt != nil {
+		p.UnpublishAt = *req.UnpublishAt
+	}
+	v.CheckProductSchedule(p.Status, p.PublishAt, p.UnpublishAt)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	err = app.storage.UpdateProduct(p, u.ID)
+	if err != nil {
+		writeProductError(err, w)
+		return
+	}
+	app.setImageURLs(p)
+	res := map[string]any{
+		"product": p,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	p, err := app.storage.GetProductByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if p == nil {
+		writeNotFound(w)
+		return
+	}
+	err = app.storage.DeleteProduct(p, u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	// the image rows went with the product, the files have to go too
+	for _, img := range p.Images {
+		app.deleteImageFiles(img.Key)
+	}
+	res := map[string]any{
+		"message": "resource deleted successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getProductFromPathValue(w http.ResponseWriter, r *http.Request) *Product {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return nil
+	}
+	p, err := app.storage.GetProductByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return nil
+	}
+	if p == nil {
+		writeNotFound(w)
+		return nil
+	}
+	return p
+}
+
+// getProductVariantFromPathValue returns the variant in the path, it is only
+// found when it belongs to the product in the path.
+func (app *Application) getProductVariantFromPathValue(w http.ResponseWriter, r *http.Request) (*Product, *ProductVariant) {
+	variantID, err := getPathValuePositiveInt(r, "variant_id")
+	if err != nil {
+		writeBadRequest(err, w)
+		return nil, nil
+	}
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return nil, nil
+	}
+	for i := range p.Variants {
+		if p.Variants[i].ID == int64(variantID) {
+			return p, &p.Variants[i]
+		}
+	}
+	writeNotFound(w)
+	return nil, nil
+}
+
+func (app *Application) getProductVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.getVisibleProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+	res := map[string]any{
+		"variants": p.Variants,
+	}
+	writeOK(res, w)
+}
+
+// writeProductVariantError reports the storage errors caused by the request
+// itself.
+func writeProductVariantError(err error, w http.ResponseWriter) {
+	v := NewValidator()
+	switch {
+	case errors.Is(err, ErrDuplicateSKU):
+		v.Check(false, "sku", "a variant with this sku already exists")
+	case errors.Is(err, ErrDuplicateVariantOptions):
+		v.Check(false, "options", "a variant with these options already exists")
+	default:
+		writeServerError(w)
+		return
+	}
+	writeValidatorErrors(v, w)
+}
+
+func (app *Application) createProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SKU      string           `json:"sku"`
+		Options  VariantOptions   `json:"options"`
+		Price    *decimal.Decimal `json:"price"`
+		Quantity int64            `json:"quantity"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckSKU(req.SKU)
+	if req.Price != nil {
+		v.Check(req.Price.GreaterThan(decimal.Zero), "price", "must be greater than zero")
+	}
+	v.Check(req.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+	v.CheckVariantOptions(req.Options, p.Options)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	variant := &ProductVariant{
+		ProductID: p.ID,
+		SKU:       req.SKU,
+		Options:   req.Options,
+		Price:     req.Price,
+		Quantity:  req.Quantity,
+	}
+	if variant.Options == nil {
+		variant.Options = VariantOptions{}
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	err := app.storage.CreateProductVariant(variant, u.ID)
+	if err != nil {
+		writeProductVariantError(err, w)
+		return
+	}
+	res := map[string]any{
+		"variant": variant,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) updateProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SKU     *string         `json:"sku"`
+		Options *VariantOptions `json:"options"`
+		// Price is a pointer to a pointer so that an explicit null removes
+		// the price override.
+		Price    **decimal.Decimal `json:"price"`
+		Quantity *int64            `json:"quantity"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	if req.SKU != nil {
+		v.CheckSKU(*req.SKU)
+	}
+	if req.Price != nil && *req.Price != nil {
+		v.Check((*req.Price).GreaterThan(decimal.Zero), "price", "must be greater than zero")
+	}
+	if req.Quantity != nil {
+		v.Check(*req.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	p, variant := app.getProductVariantFromPathValue(w, r)
+	if variant == nil {
+		return
+	}
+	if req.Options != nil {
+		v.CheckVariantOptions(*req.Options, p.Options)
+		if v.HasError() {
+			writeValidatorErrors(v, w)
+			return
+		}
+		variant.Options = *req.Options
+		if variant.Options == nil {
+			variant.Options = VariantOptions{}
+		}
+	}
+	if req.SKU != nil {
+		variant.SKU = *req.SKU
+	}
+	if req.Price != nil {
+		variant.Price = *req.Price
+	}
+	if req.Quantity != nil {
+		variant.Quantity = *req.Quantity
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	err := app.storage.UpdateProductVariant(variant, u.ID)
+	if err != nil {
+		writeProductVariantError(err, w)
+		return
+	}
+	res := map[string]any{
+		"variant": variant,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	_, variant := app.getProductVariantFromPathValue(w, r)
+	if variant == nil {
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	err := app.storage.DeleteProductVariant(variant, u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "resource deleted successfully",
+	}
+	writeOK(res, w)
+}
+
+// setImageURLs sets the URLs of the product images from the image store.
+func (app *Application) setImageURLs(p *Product) {
+	for i := range p.Images {
+		img := &p.Images[i]
+		img.URL = app.images.URL(img.Key)
+		img.Thumbnails = make(map[string]string, len(thumbnailWidths))
+		for _, width := range thumbnailWidths {
+			img.Thumbnails[strconv.Itoa(width)] = app.images.URL(thumbnailKey(img.Key, width))
+		}
+	}
+}
+
+// deleteImageFiles removes the image and its thumbnails from the image store,
+// failures are only logged since the files are not referenced anymore.
+func (app *Application) deleteImageFiles(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keys := []string{key}
+	for _, width := range thumbnailWidths {
+		keys = append(keys, thumbnailKey(key, width))
+	}
+	for _, k := range keys {
+		err := app.images.Delete(ctx, k)
+		if err != nil {
+			log.Printf("failed to delete image %s: %v\n", k, err)
+		}
+	}
+}
 
-	writeJSON(token, http.StatusCreated, w)
-}
-
-func (app *Application) createUserActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+func (app *Application) getProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.getVisibleProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+	app.setImageURLs(p)
+	res := map[string]any{
+		"images": p.Images,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) createProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	// leave some room for the multipart envelope around the image
+	maxSize := app.config.images.maxSize
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	err := r.ParseMultipartForm(maxSize)
+	if err != nil {
+		writeBadRequest(fmt.Errorf("body must be a multipart form with an image of at most %d bytes", maxSize), w)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	v := NewValidator()
+	file, header, err := r.FormFile("image")
+	v.Check(err == nil, "image", "must be provided")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	defer file.Close()
+
+	v.Check(header.Size <= maxSize, "image", fmt.Sprintf("must not be larger than %d bytes", maxSize))
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := imageExtensions[contentType]
+	v.Check(ok, "image", "must be a JPEG, PNG or GIF image")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	v.Check(err == nil, "image", "must be a valid image")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	v.Check(config.Width <= maxImageWidth && config.Height <= maxImageHeight, "image", fmt.Sprintf("must not be larger than %dx%d pixels", maxImageWidth, maxImageHeight))
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	v.Check(err == nil, "image", "must be a valid image")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	name, err := randomURLString(16)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	img := &ProductImage{
+		ProductID:   p.ID,
+		Key:         fmt.Sprintf("products/%d/%s%s", p.ID, name, ext),
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+
+	err = app.images.Put(r.Context(), img.Key, bytes.NewReader(data), contentType)
+	if err != nil {
+		app.deleteImageFiles(img.Key)
+		writeServerError(w)
+		return
+	}
+	for _, width := range thumbnailWidths {
+		var buf bytes.Buffer
+		err = encodeImage(&buf, resizeImage(src, width), contentType)
+		if err == nil {
+			err = app.images.Put(r.Context(), thumbnailKey(img.Key, width), &buf, contentType)
+		}
+		if err != nil {
+			app.deleteImageFiles(img.Key)
+			writeServerError(w)
+			return
+		}
+	}
+
+	err = app.storage.CreateProductImage(img, u.ID)
+	if err != nil {
+		app.deleteImageFiles(img.Key)
+		writeServerError(w)
+		return
+	}
+
+	p.Images = []ProductImage{*img}
+	app.setImageURLs(p)
+	res := map[string]any{
+		"image": p.Images[0],
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) reorderProductImagesHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Email string `json:"email"`
+		ImageIDs []int64 `json:"image_ids"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+
+	current := make([]int64, len(p.Images))
+	for i := range p.Images {
+		current[i] = p.Images[i].ID
+	}
+	ids := slices.Clone(req.ImageIDs)
+	slices.Sort(ids)
+	slices.Sort(current)
+	v := NewValidator()
+	v.Check(slices.Equal(ids, current), "image_ids", "must contain every image of the product exactly once")
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	err := app.storage.ReorderProductImages(p.ID, req.ImageIDs, u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	images, err := app.storage.GetProductsImages(p.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	p.Images = images[p.ID]
+	app.setImageURLs(p)
+	res := map[string]any{
+		"images": p.Images,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageID, err := getPathValuePositiveInt(r, "image_id")
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
+		return
+	}
+	idx := slices.IndexFunc(p.Images, func(img ProductImage) bool {
+		return img.ID == int64(imageID)
+	})
+	if idx == -1 {
+		writeNotFound(w)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	if u == nil {
+		writeServerError(w)
+		return
+	}
+
+	err = app.storage.DeleteProductImage(&p.Images[idx], u.ID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	app.deleteImageFiles(p.Images[idx].Key)
+	res := map[string]any{
+		"message": "resource deleted successfully",
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID := int64(0)
+	categoryStr := r.URL.Query().Get("category")
+	if categoryStr != "" {
+		v, err := strconv.ParseInt(categoryStr, 10, 64)
+		if err != nil || v <= 0 {
+			writeBadRequest(errors.New("category: must be a positive integer"), w)
+			return
+		}
+		categoryID = v
+	}
+	attributes, err := app.storage.GetAttributes(categoryID)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"attributes": attributes,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) getAttributeFromPathValue(w http.ResponseWriter, r *http.Request) *Attribute {
+	id, err := getIDFromPathValue(r)
+	if err != nil {
+		writeBadRequest(err, w)
+		return nil
+	}
+	a, err := app.storage.GetAttributeByID(int64(id))
+	if err != nil {
+		writeServerError(w)
+		return nil
+	}
+	if a == nil {
+		writeNotFound(w)
+		return nil
+	}
+	return a
+}
+
+func (app *Application) getAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	a := app.getAttributeFromPathValue(w, r)
+	if a == nil {
+		return
+	}
+	res := map[string]any{
+		"attribute": a,
+	}
+	writeOK(res, w)
+}
+
+// writeAttributeError reports the storage errors caused by the request itself.
+func writeAttributeError(err error, w http.ResponseWriter) {
+	v := NewValidator()
+	switch {
+	case errors.Is(err, ErrDuplicateAttributeCode):
+		v.Check(false, "code", "an attribute with this code already exists")
+	case errors.Is(err, ErrUnknownCategory):
+		v.Check(false, "category_id", "does not exist")
+	default:
+		writeServerError(w)
+		return
+	}
+	writeValidatorErrors(v, w)
+}
+
+func (app *Application) createAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CategoryID *int64        `json:"category_id"`
+		Code       string        `json:"code"`
+		Name       string        `json:"name"`
+		Type       AttributeType `json:"type"`
+		Unit       string        `json:"unit"`
+		EnumValues []string      `json:"enum_values"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	v.CheckAttributeCode(req.Code)
+	v.Check(req.Name != "", "name", "must be provided")
+	v.Check(len(req.Name) <= 50, "name", "must not be more than 50 characters")
+	types := []AttributeType{AttributeString, AttributeNumber, AttributeBoolean, AttributeEnum}
+	v.Check(slices.Index(types, req.Type) != -1, "type", `must be one of "string", "number", "boolean" or "enum"`)
+	v.Check(len(req.Unit) <= 20, "unit", "must not be more than 20 characters")
+	v.CheckEnumValues(req.Type, req.EnumValues)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	a := &Attribute{
+		CategoryID: req.CategoryID,
+		Code:       req.Code,
+		Name:       req.Name,
+		Type:       req.Type,
+		Unit:       req.Unit,
+		EnumValues: req.EnumValues,
+	}
+	if a.EnumValues == nil {
+		a.EnumValues = []string{}
+	}
+	err := app.storage.CreateAttribute(a)
+	if err != nil {
+		writeAttributeError(err, w)
+		return
+	}
+	res := map[string]any{
+		"attribute": a,
+	}
+	writeJSON(res, http.StatusCreated, w)
+}
+
+func (app *Application) updateAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		// CategoryID is a pointer to a pointer so that an explicit null makes
+		// the attribute global.
+		CategoryID **int64   `json:"category_id"`
+		Code       *string   `json:"code"`
+		Name       *string   `json:"name"`
+		Unit       *string   `json:"unit"`
+		EnumValues *[]string `json:"enum_values"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	v := NewValidator()
+	if req.Code != nil {
+		v.CheckAttributeCode(*req.Code)
+	}
+	if req.Name != nil {
+		v.Check(*req.Name != "", "name", "must be provided")
+		v.Check(len(*req.Name) <= 50, "name", "must not be more than 50 characters")
+	}
+	if req.Unit != nil {
+		v.Check(len(*req.Unit) <= 20, "unit", "must not be more than 20 characters")
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	a := app.getAttributeFromPathValue(w, r)
+	if a == nil {
+		return
+	}
+	if req.EnumValues != nil {
+		v.CheckEnumValues(a.Type, *req.EnumValues)
+		if v.HasError() {
+			writeValidatorErrors(v, w)
+			return
+		}
+		a.EnumValues = *req.EnumValues
+	}
+	if req.CategoryID != nil {
+		a.CategoryID = *req.CategoryID
+	}
+	if req.Code != nil {
+		a.Code = *req.Code
+	}
+	if req.Name != nil {
+		a.Name = *req.Name
+	}
+	if req.Unit != nil {
+		a.Unit = *req.Unit
+	}
+	err := app.storage.UpdateAttribute(a)
+	if err != nil {
+		writeAttributeError(err, w)
+		return
+	}
+	res := map[string]any{
+		"attribute": a,
+	}
+	writeOK(res, w)
+}
+
+func (app *Application) deleteAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	a := app.getAttributeFromPathValue(w, r)
+	if a == nil {
+		return
+	}
+	err := app.storage.DeleteAttribute(a)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	res := map[string]any{
+		"message": "resource deleted successfully",
+	}
+	writeOK(res, w)
+}
+
+// updateProductAttributesHandler sets the attribute values given by code, a
+// null value removes the attribute from the product.
+func (app *Application) updateProductAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Attributes map[string]json.RawMessage `json:"attributes"`
 	}
-	err := readJSON(r, &req)
-	if err != nil {
+	if err := readJSON(r, &req); err != nil {
 		writeBadRequest(err, w)
 		return
 	}
 
 	v := NewValidator()
-	v.CheckEmail(req.Email)
+	v.Check(len(req.Attributes) > 0, "attributes", "must be provided")
 	if v.HasError() {
 		writeValidatorErrors(v, w)
 		return
 	}
 
-	u, err := app.storage.GetUserByEmail(req.Email)
-	if err != nil {
-		writeServerError(w)
-		return
-	}
-
-	if u == nil {
-		writeBadRequest(errors.New("invalid email"), w)
-		return
-	}
-
-	if u.IsActivated {
-		writeError(errors.New("user is already activated"), http.StatusConflict, w)
+	p := app.getProductFromPathValue(w, r)
+	if p == nil {
 		return
 	}
-
-	token, err := app.storage.CreateToken(u.ID, 5*time.Minute, ScopeActivation)
+	applicable, err := app.storage.GetApplicableAttributes(p.ID)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
 
-	go func(email string, token Token) {
-		tmpl, err := template.ParseFS(templates, "templates/*.gotmpl")
-		if err != nil {
-			log.Println(err)
-			return
+	values := []AttributeValue{}
+	removed := []int64{}
+	for code, raw := range req.Attributes {
+		idx := slices.IndexFunc(applicable, func(a Attribute) bool {
+			return a.Code == code
+		})
+		key := "attributes." + code
+		v.Check(idx != -1, key, "does not exist or does not apply to the categories of the product")
+		if idx == -1 {
+			continue
 		}
-		err = app.mailer.Send(email, tmpl, map[string]any{"token": token.Text})
+		if string(raw) == "null" {
+			removed = append(removed, applicable[idx].ID)
+			continue
+		}
+		value, err := applicable[idx].ParseJSONValue(raw)
 		if err != nil {
-			log.Println(err)
+			v.Check(false, key, err.Error())
+			continue
 		}
-	}(req.Email, *token)
-
-	res := map[string]any{
-		"message": fmt.Sprintf("an activation token was sent to email %s", req.Email),
-	}
-	writeJSON(res, http.StatusCreated, w)
-}
-
-func (app *Application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Token string `json:"token"`
+		values = append(values, *value)
 	}
-	if err := readJSON(r, &req); err != nil {
-		writeBadRequest(err, w)
+	if v.HasError() {
+		writeValidatorErrors(v, w)
 		return
 	}
-	u, err := app.storage.GetUserFromToken(req.Token, ScopeActivation)
-	if err != nil {
+
+	u := getUserFromRequest(r)
+	if u == nil {
 		writeServerError(w)
 		return
 	}
-	if u == nil {
-		writeBadRequest(errors.New("invalid token"), w)
+
+	err = app.storage.SetProductAttributes(p.ID, values, removed, u.ID)
+	if err != nil {
+		writeServerError(w)
 		return
 	}
-	u.IsActivated = true
-	err = app.storage.UpdateUser(u)
+	attributes, err := app.storage.GetProductsAttributes(p.ID)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
 	res := map[string]any{
-		"message": "user activated",
+		"attributes": attributes[p.ID],
 	}
 	writeOK(res, w)
 }
 
-func (app *Application) createProductHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Name        string          `json:"name"`
-		Description string          `json:"description"`
-		Price       decimal.Decimal `json:"price"`
-		Quantity    int64           `json:"quantity"`
-	}
-
-	if err := readJSON(r, &req); err != nil {
-		writeBadRequest(err, w)
-		return
+// parseAttributeFilters reads the attribute filters of the product listing:
+// attr.<code>=<value> for equality and attr.<code>.min or attr.<code>.max for
+// number ranges.
+func (app *Application) parseAttributeFilters(query url.Values, v *Validator) ([]AttributeFilter, error) {
+	codes := []string{}
+	for param := range query {
+		code, ok := strings.CutPrefix(param, "attr.")
+		if !ok {
+			continue
+		}
+		code = strings.TrimSuffix(strings.TrimSuffix(code, ".min"), ".max")
+		if slices.Index(codes, code) == -1 {
+			codes = append(codes, code)
+		}
 	}
-
-	v := NewValidator()
-	v.Check(req.Name != "", "name", "must be provided")
-	v.Check(len(req.Name) <= 50, "name", "must not be more than 50 characters")
-	v.Check(req.Description != "", "description", "must be provided")
-	v.Check(req.Price.GreaterThan(decimal.NewFromInt(0)), "price", "must be greater than zero")
-	v.Check(req.Quantity >= 0, "quantity", "must be greater than or equal zero")
-
-	if v.HasError() {
-		writeValidatorErrors(v, w)
-		return
+	if len(codes) == 0 {
+		return nil, nil
 	}
 
-	u := getUserFromRequest(r)
-	if u == nil {
-		writeServerError(w)
-		return
+	attributes, err := app.storage.GetAttributesByCodes(codes)
+	if err != nil {
+		return nil, err
+	}
+	filters := []AttributeFilter{}
+	for _, code := range codes {
+		key := "attr." + code
+		idx := slices.IndexFunc(attributes, func(a Attribute) bool {
+			return a.Code == code
+		})
+		v.Check(idx != -1, key, "attribute does not exist")
+		if idx == -1 {
+			continue
+		}
+		a := attributes[idx]
+		f := AttributeFilter{Attribute: a}
+		if query.Has(key) {
+			value, err := a.ParseValue(query.Get(key))
+			if err != nil {
+				v.Check(false, key, err.Error())
+				continue
+			}
+			f.Equals = value
+		}
+		for suffix, dst := range map[string]**decimal.Decimal{".min": &f.Min, ".max": &f.Max} {
+			if !query.Has(key + suffix) {
+				continue
+			}
+			v.Check(a.Type == AttributeNumber, key+suffix, "ranges are only supported by number attributes")
+			n, err := decimal.NewFromString(query.Get(key + suffix))
+			v.Check(err == nil, key+suffix, "must be a number")
+			if err == nil {
+				*dst = &n
+			}
+		}
+		filters = append(filters, f)
 	}
+	return filters, nil
+}
 
-	p, err := app.storage.CreateProduct(req.Name, req.Description, req.Price, req.Quantity)
+func (app *Application) getCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := app.storage.GetCategories()
 	if err != nil {
 		writeServerError(w)
 		return
 	}
 	res := map[string]any{
-		"product": p,
+		"categories": buildCategoryTree(categories),
 	}
-	writeJSON(res, http.StatusCreated, w)
+	writeOK(res, w)
 }
 
-func (app *Application) getProductHandler(w http.ResponseWriter, r *http.Request) {
+func (app *Application) getCategoryFromPathValue(w http.ResponseWriter, r *http.Request) *Category {
 	id, err := getIDFromPathValue(r)
 	if err != nil {
 		writeBadRequest(err, w)
-		return
+		return nil
 	}
-	p, err := app.storage.GetProductByID(int64(id))
+	c, err := app.storage.GetCategoryByID(int64(id))
 	if err != nil {
 		writeServerError(w)
-		return
+		return nil
 	}
-	if p == nil {
+	if c == nil {
 		writeNotFound(w)
+		return nil
+	}
+	return c
+}
+
+func (app *Application) getCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	c := app.getCategoryFromPathValue(w, r)
+	if c == nil {
+		return
+	}
+	path, err := app.storage.GetCategoryPath(c)
+	if err != nil {
+		writeServerError(w)
 		return
 	}
 	res := map[string]any{
-		"product": p,
+		"category": c,
+		"path":     path,
 	}
 	writeOK(res, w)
 }
 
-func (app *Application) getProductsHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	name := query.Get("name")
-	description := query.Get("description")
-
-	sort := query.Get("sort")
-	if sort == "" {
-		sort = "id"
-	}
-
-	minPrice := decimal.Zero
-	minPriceStr := query.Get("min_price")
-	if minPriceStr != "" {
-		v, err := decimal.NewFromString(minPriceStr)
-		if err != nil {
-			writeError(err, http.StatusBadRequest, w)
-			return
-		}
-		minPrice = v
+// writeCategoryError reports the storage errors caused by the request itself.
+func writeCategoryError(err error, w http.ResponseWriter) {
+	v := NewValidator()
+	switch {
+	case errors.Is(err, ErrDuplicateSlug):
+		v.Check(false, "slug", "a category with this slug already exists")
+	case errors.Is(err, ErrUnknownCategory):
+		v.Check(false, "parent_id", "does not exist")
+	case errors.Is(err, ErrCategoryCycle):
+		v.Check(false, "parent_id", "must not be the category itself or one of its subcategories")
+	default:
+		writeServerError(w)
+		return
 	}
+	writeValidatorErrors(v, w)
+}
 
-	maxPrice := decimal.NewFromFloat(math.MaxFloat64)
-	maxPriceStr := query.Get("max_price")
-	if maxPriceStr != "" {
-		v, err := decimal.NewFromString(maxPriceStr)
-		if err != nil {
-			writeError(err, http.StatusBadRequest, w)
-			return
-		}
-		maxPrice = v
+func (app *Application) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ParentID    *int64 `json:"parent_id"`
+		Name        string `json:"name"`
+		Slug        string `json:"slug"`
+		Description string `json:"description"`
 	}
-
-	page := 1
-	pageStr := query.Get("page")
-	if pageStr != "" {
-		v, err := strconv.Atoi(pageStr)
-		if err != nil {
-			writeError(err, http.StatusBadRequest, w)
-			return
-		}
-		page = v
+	if err := readJSON(r, &req); err != nil {
+		writeBadRequest(err, w)
+		return
 	}
-	pageSize := 5
-	pageSizeStr := query.Get("page_size")
-	if pageSizeStr != "" {
-		v, err := strconv.Atoi(pageSizeStr)
-		if err != nil {
-			writeError(err, http.StatusBadRequest, w)
-			return
-		}
-		page = v
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
 	}
 
 	v := NewValidator()
-	v.Check(minPrice.GreaterThanOrEqual(decimal.Zero), "min_price", "must be greater than zero or equal zero")
-	v.Check(maxPrice.GreaterThanOrEqual(decimal.Zero), "max_price", "must be greater than zero or equal zero")
-	v.Check(maxPrice.GreaterThanOrEqual(minPrice), "max_price", `must be greater than or equal "min_price"`)
-	v.Check(page > 0, "page", "must be greater than zero")
-	v.Check(page <= 10_000_000, "page", "must be less than or equal to 10_000_000")
-	v.Check(pageSize > 0, "page_size", "must be greater than zero")
-	v.Check(pageSize <= 100, "page_size", "must be less than or equal to 100")
-	sortOptions := []string{"id", "-id", "name", "-name", "created_at", "-created_at", "price", "-price"}
-	v.Check(slices.Index(sortOptions, sort) != -1, sort, "search option is not supported")
-
+	v.Check(req.Name != "", "name", "must be provided")
+	v.Check(len(req.Name) <= 50, "name", "must not be more than 50 characters")
+	v.CheckSlug(req.Slug)
 	if v.HasError() {
 		writeValidatorErrors(v, w)
 		return
 	}
 
-	products, total, err := app.storage.GetProducts(name, description, sort, minPrice, maxPrice, page, pageSize)
+	c := &Category{
+		ParentID:    req.ParentID,
+		Name:        req.Name,
+		Slug:        req.Slug,
+		Description: req.Description,
+	}
+	err := app.storage.CreateCategory(c)
 	if err != nil {
-		writeServerError(w)
+		writeCategoryError(err, w)
 		return
 	}
 	res := map[string]any{
-		"product": products,
-		"total":   total,
+		"category": c,
 	}
-	writeOK(res, w)
+	writeJSON(res, http.StatusCreated, w)
 }
 
-func (app *Application) updateProductHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := getIDFromPathValue(r)
-	if err != nil {
-		writeBadRequest(err, w)
-		return
-	}
+func (app *Application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name        *string          `json:"name"`
-		Description *string          `json:"description"`
-		Price       *decimal.Decimal `json:"price"`
-		Quantity    *int64           `json:"quantity"`
+		// ParentID is a pointer to a pointer so that an explicit null moves
+		// the category to the root.
+		ParentID    **int64 `json:"parent_id"`
+		Name        *string `json:"name"`
+		Slug        *string `json:"slug"`
+		Description *string `json:"description"`
 	}
 	if err := readJSON(r, &req); err != nil {
-		writeError(err, http.StatusBadRequest, w)
+		writeBadRequest(err, w)
 		return
 	}
 
@@ -505,82 +3704,52 @@ func (app *Application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 		v.Check(*req.Name != "", "name", "must be provided")
 		v.Check(len(*req.Name) <= 50, "name", "must not be more than 50 characters")
 	}
-	if req.Description != nil {
-		v.Check(*req.Description != "", "description", "must be provided")
-	}
-	if req.Price != nil {
-		v.Check(req.Price.GreaterThan(decimal.NewFromInt(0)), "price", "must be greater than zero")
-	}
-	if req.Quantity != nil {
-		v.Check(*req.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	if req.Slug != nil {
+		v.CheckSlug(*req.Slug)
 	}
 	if v.HasError() {
 		writeValidatorErrors(v, w)
 		return
 	}
 
-	u := getUserFromRequest(r)
-	if u == nil {
-		writeServerError(w)
-		return
-	}
-
-	p, err := app.storage.GetProductByID(int64(id))
-	if err != nil {
-		writeServerError(w)
+	c := app.getCategoryFromPathValue(w, r)
+	if c == nil {
 		return
 	}
-	if p == nil {
-		writeNotFound(w)
-		return
+	if req.ParentID != nil {
+		c.ParentID = *req.ParentID
 	}
 	if req.Name != nil {
-		p.Name = *req.Name
-	}
-	if req.Description != nil {
-		p.Description = *req.Description
+		c.Name = *req.Name
 	}
-	if req.Price != nil {
-		p.Price = *req.Price
+	if req.Slug != nil {
+		c.Slug = *req.Slug
 	}
-	if req.Quantity != nil {
-		p.Quantity = *req.Quantity
+	if req.Description != nil {
+		c.Description = *req.Description
 	}
-	err = app.storage.UpdateProduct(p)
+	err := app.storage.UpdateCategory(c)
 	if err != nil {
-		writeServerError(w)
+		writeCategoryError(err, w)
 		return
 	}
 	res := map[string]any{
-		"product": p,
+		"category": c,
 	}
 	writeOK(res, w)
 }
 
-func (app *Application) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := getIDFromPathValue(r)
-	if err != nil {
-		writeBadRequest(err, w)
-		return
-	}
-
-	u := getUserFromRequest(r)
-	if u == nil {
-		writeServerError(w)
-		return
-	}
-
-	p, err := app.storage.GetProductByID(int64(id))
-	if err != nil {
-		writeServerError(w)
+func (app *Application) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	c := app.getCategoryFromPathValue(w, r)
+	if c == nil {
 		return
 	}
-	if p == nil {
-		writeNotFound(w)
-		return
-	}
-	err = app.storage.DeleteProduct(p)
+	err := app.storage.DeleteCategory(c)
 	if err != nil {
+		if errors.Is(err, ErrCategoryHasChildren) {
+			writeError(err, http.StatusConflict, w)
+			return
+		}
 		writeServerError(w)
 		return
 	}
@@ -592,8 +3761,9 @@ func (app *Application) deleteProductHandler(w http.ResponseWriter, r *http.Requ
 
 func (app *Application) createCartItemHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ProductID int64 `json:"product_id"`
-		Quantity  int64 `json:"Quantity"`
+		ProductID int64  `json:"product_id"`
+		VariantID *int64 `json:"variant_id"`
+		Quantity  int64  `json:"Quantity"`
 	}
 	if err := readJSON(r, &req); err != nil {
 		writeBadRequest(err, w)
@@ -621,13 +3791,37 @@ func (app *Application) createCartItemHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if p == nil {
+	if p == nil || p.Status != ProductPublished {
 		writeNotFound(w)
 		return
 	}
 
-	if p.Quantity < req.Quantity {
-		req.Quantity = p.Quantity
+	// products with variants are bought per variant, the others as a whole
+	stock := p.Quantity
+	if len(p.Variants) > 0 {
+		v.Check(req.VariantID != nil, "variant_id", "must be provided")
+		if v.HasError() {
+			writeValidatorErrors(v, w)
+			return
+		}
+		idx := slices.IndexFunc(p.Variants, func(variant ProductVariant) bool {
+			return variant.ID == *req.VariantID
+		})
+		if idx == -1 {
+			writeNotFound(w)
+			return
+		}
+		stock = p.Variants[idx].Quantity
+	} else {
+		v.Check(req.VariantID == nil, "variant_id", "must not be provided for a product without variants")
+		if v.HasError() {
+			writeValidatorErrors(v, w)
+			return
+		}
+	}
+
+	if stock < req.Quantity {
+		req.Quantity = stock
 	}
 
 	if req.Quantity == 0 {
@@ -635,7 +3829,7 @@ func (app *Application) createCartItemHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	cartItem, err := app.storage.CreateCartItem(req.ProductID, u.ID, req.Quantity)
+	cartItem, err := app.storage.CreateCartItem(req.ProductID, req.VariantID, u.ID, req.Quantity)
 	if err != nil {
 		writeServerError(w)
 		return
@@ -1011,17 +4205,51 @@ func (app *Application) getOrdersHandler(w http.ResponseWriter, r *http.Request)
 		writeServerError(w)
 		return
 	}
-	orders, err := app.storage.GetOrdersItems(u.ID)
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "id"
+	}
+	pageSize := 20
+	pageSizeStr := query.Get("page_size")
+	if pageSizeStr != "" {
+		v, err := strconv.Atoi(pageSizeStr)
+		if err != nil {
+			writeBadRequest(err, w)
+			return
+		}
+		pageSize = v
+	}
+
+	v := NewValidator()
+	v.Check(sort == "id" || sort == "-id", "sort", "search option is not supported")
+	v.Check(pageSize > 0, "page_size", "must be greater than zero")
+	v.Check(pageSize <= 100, "page_size", "must be less than or equal to 100")
+	var c *Cursor
+	cursor := query.Get("cursor")
+	if cursor != "" {
+		var err error
+		c, err = DecodeCursor(cursor)
+		v.Check(err == nil, "cursor", "must be valid")
+		v.Check(err != nil || c.Sort == sort, "cursor", `must be used with the "sort" it was issued for`)
+	}
+	if v.HasError() {
+		writeValidatorErrors(v, w)
+		return
+	}
+
+	orders, pagination, err := app.storage.GetOrdersItemsPage(u.ID, sort, c, pageSize)
 	if err != nil {
 		writeServerError(w)
 		return
 	}
-	if orders == nil {
+	if len(orders) == 0 && c == nil {
 		writeNotFound(w)
 		return
 	}
 	res := map[string]any{
-		"orders": orders,
+		"orders":   orders,
+		"metadata": pagination,
 	}
 	writeOK(res, w)
 }
@@ -4,10 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"unicode"
 )
 
 func getPathValuePositiveInt(r *http.Request, p string) (int, error) {
@@ -29,6 +33,45 @@ func getIDFromPathValue(r *http.Request) (int, error) {
 	return id, nil
 }
 
+// slugify turns a name into a URL friendly slug, e.g. "Men's Shoes" becomes
+// "men-s-shoes".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// searchWords splits the text typed in a search box into lowercase words of
+// letters and digits, at most 10 of them.
+func searchWords(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 10 {
+		words = words[:10]
+	}
+	return words
+}
+
+func getClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 func readJSON(r *http.Request, dst any) error {
 	err := json.NewDecoder(r.Body).Decode(dst)
 	if err != nil {
@@ -108,3 +151,17 @@ func (app *Application) background(fn func()) {
 		fn()
 	}()
 }
+
+func (app *Application) sendMail(to, templateFile string, data any) {
+	app.background(func() {
+		tmpl, err := template.ParseFS(templates, "templates/"+templateFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		err = app.mailer.Send(to, tmpl, data)
+		if err != nil {
+			log.Printf("failed to send email to %s: %v\n", to, err)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Every uploaded image gets a thumbnail for each of these widths. Thumbnails
+// are stored next to the original with the width appended to the key, e.g.
+// products/1/abc.jpg and products/1/abc_160.jpg.
+var thumbnailWidths = []int{160, 480}
+
+// Images larger than this are rejected before being decoded so a small file
+// cannot expand into a huge bitmap in memory.
+const (
+	maxImageWidth  = 8000
+	maxImageHeight = 8000
+)
+
+// imageExtensions lists the accepted content types of uploaded images.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// ImageStore persists uploaded images under a key and knows the public URL of
+// each key. The local filesystem is the only backend for now, an S3 compatible
+// one only needs to implement the same methods.
+type ImageStore interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+func NewImageStore(backend, dir, baseURL string) (ImageStore, error) {
+	switch backend {
+	case "local":
+		return NewLocalImageStore(dir, baseURL)
+	default:
+		return nil, fmt.Errorf("unsupported image storage backend %q", backend)
+	}
+}
+
+// LocalImageStore keeps the images in a directory which is served by the API
+// itself under baseURL.
+type LocalImageStore struct {
+	dir     string
+	baseURL string
+}
+
+func NewLocalImageStore(dir, baseURL string) (*LocalImageStore, error) {
+	if localImagesPath(baseURL) == "" {
+		return nil, fmt.Errorf("images base url %q must have a path the images can be served under", baseURL)
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalImageStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// localImagesPath returns the path the API serves the local images under, with
+// a trailing slash, or "" when baseURL has no usable path. The base URL can
+// point to a proxy in front of the API as long as it keeps the path.
+func localImagesPath(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+func (s *LocalImageStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first so a partially written image is never
+// served.
+func (s *LocalImageStore) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	p := s.path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *LocalImageStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalImageStore) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+func thumbnailKey(key string, width int) string {
+	ext := path.Ext(key)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(key, ext), width, ext)
+}
+
+// resizeImage scales the image down to the width keeping its aspect ratio,
+// each destination pixel is the average of the source pixels it covers.
+// Images narrower than the width are returned unchanged.
+func resizeImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported image content type %q", contentType)
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// productColumns are the fields of the bulk import and export formats, an
+// export can be edited and imported back. In CSV lists are separated by
+// listSeparator and an empty cell leaves the field of an existing product
+// unchanged, in NDJSON a missing or null field does.
+var productColumns = []string{"id", "sku", "name", "description", "price", "quantity", "status", "publish_at", "unpublish_at", "category_ids", "options"}
+
+const listSeparator = "|"
+
+const (
+	maxProductImportSize   = 16 << 20
+	maxProductImportRows   = 50_000
+	maxProductImportErrors = 1000
+	// the progress of an import is saved every productImportProgressRows rows
+	productImportProgressRows = 100
+)
+
+// productFormats maps the import and export formats to their content type.
+var productFormats = map[string]string{
+	"csv":    "text/csv",
+	"ndjson": "application/x-ndjson",
+}
+
+// productImportRow holds the fields of an imported row, nil fields are not
+// changed on existing products.
+type productImportRow struct {
+	ID          *int64           `json:"id"`
+	SKU         *string          `json:"sku"`
+	Name        *string          `json:"name"`
+	Description *string          `json:"description"`
+	Price       *decimal.Decimal `json:"price"`
+	Quantity    *int64           `json:"quantity"`
+	Status      *ProductStatus   `json:"status"`
+	PublishAt   *time.Time       `json:"publish_at"`
+	UnpublishAt *time.Time       `json:"unpublish_at"`
+	CategoryIDs *[]int64         `json:"category_ids"`
+	Options     *[]string        `json:"options"`
+
+	// number is the position of the row in the file and errs holds the
+	// errors of a row that could not be parsed.
+	number int
+	errs   *Validator
+}
+
+// readProductImportRows parses the whole file. Rows that cannot be parsed are
+// returned with their errors, the error is only set when the file itself is
+// unusable.
+func readProductImportRows(format string, r io.Reader) ([]productImportRow, error) {
+	switch format {
+	case "csv":
+		return readCSVProductRows(r)
+	case "ndjson":
+		return readNDJSONProductRows(r)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+func readCSVProductRows(r io.Reader) ([]productImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("file must start with a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		if slices.Index(productColumns, header[i]) == -1 {
+			return nil, fmt.Errorf("unknown column %q, the columns are %q", header[i], productColumns)
+		}
+		if slices.Index(header[:i], header[i]) != -1 {
+			return nil, fmt.Errorf("duplicate column %q", header[i])
+		}
+	}
+
+	rows := []productImportRow{}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		row := productImportRow{}
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			row.errs = NewValidator()
+			row.errs.Check(false, "row", parseErr.Err.Error())
+		case err != nil:
+			return nil, err
+		case len(record) != len(header):
+			row.errs = NewValidator()
+			row.errs.Check(false, "row", fmt.Sprintf("must have %d fields", len(header)))
+		default:
+			row = parseCSVProductRow(header, record)
+		}
+		row.number = len(rows) + 1
+		rows = append(rows, row)
+		if len(rows) > maxProductImportRows {
+			return nil, fmt.Errorf("file must not have more than %d rows", maxProductImportRows)
+		}
+	}
+	return rows, nil
+}
+
+func parseCSVProductRow(header, record []string) productImportRow {
+	row := productImportRow{}
+	v := NewValidator()
+	for i, column := range header {
+		cell := strings.TrimSpace(record[i])
+		if cell == "" {
+			continue
+		}
+		switch column {
+		case "id":
+			id, err := strconv.ParseInt(cell, 10, 64)
+			v.Check(err == nil && id > 0, column, "must be a positive integer")
+			row.ID = &id
+		case "sku":
+			row.SKU = &cell
+		case "name":
+			row.Name = &cell
+		case "description":
+			row.Description = &cell
+		case "price":
+			price, err := decimal.NewFromString(cell)
+			v.Check(err == nil, column, "must be a number")
+			row.Price = &price
+		case "quantity":
+			quantity, err := strconv.ParseInt(cell, 10, 64)
+			v.Check(err == nil, column, "must be an integer")
+			row.Quantity = &quantity
+		case "status":
+			status := ProductStatus(cell)
+			row.Status = &status
+		case "publish_at", "unpublish_at":
+			t, err := time.Parse(time.RFC3339, cell)
+			v.Check(err == nil, column, "must be an RFC 3339 timestamp")
+			if column == "publish_at" {
+				row.PublishAt = &t
+			} else {
+				row.UnpublishAt = &t
+			}
+		case "category_ids":
+			ids := []int64{}
+			for _, s := range strings.Split(cell, listSeparator) {
+				id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+				v.Check(err == nil && id > 0, column, fmt.Sprintf("must be positive integers separated by %q", listSeparator))
+				ids = append(ids, id)
+			}
+			row.CategoryIDs = &ids
+		case "options":
+			options := strings.Split(cell, listSeparator)
+			for i := range options {
+				options[i] = strings.TrimSpace(options[i])
+			}
+			row.Options = &options
+		}
+	}
+	if v.HasError() {
+		row.errs = v
+	}
+	return row
+}
+
+func readNDJSONProductRows(r io.Reader) ([]productImportRow, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	rows := []productImportRow{}
+	// n is left on the line the scanner stopped at
+	n := 1
+	for ; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		row := productImportRow{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&row)
+		if err != nil {
+			row = productImportRow{errs: NewValidator()}
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				row.errs.Check(false, typeErr.Field, "has an incorrect JSON type")
+			} else {
+				row.errs.Check(false, "row", "must be a JSON object with the fields "+strings.Join(productColumns, ", "))
+			}
+		}
+		row.number = n
+		rows = append(rows, row)
+		if len(rows) > maxProductImportRows {
+			return nil, fmt.Errorf("file must not have more than %d rows", maxProductImportRows)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("line %d must not be longer than 1MB", n)
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// importProduct creates or updates the product of the row on behalf of the
+// user, the product is matched by id first and by sku otherwise. Nothing is
+// written in a dry run. The validator holds the errors of a rejected row, the
+// error is only set when the import cannot go on.
+func (app *Application) importProduct(row productImportRow, userID int64, categoryIDs map[int64]bool, dryRun bool) (bool, *Validator, error) {
+	v := NewValidator()
+	var p *Product
+	var err error
+	switch {
+	case row.ID != nil:
+		p, err = app.storage.GetProductByID(*row.ID)
+		if err != nil {
+			return false, nil, err
+		}
+		v.Check(p != nil, "id", "does not exist")
+		if p == nil {
+			return false, v, nil
+		}
+	case row.SKU != nil:
+		p, err = app.storage.GetProductBySKU(*row.SKU)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	created := p == nil
+	if created {
+		p = &Product{Status: ProductDraft}
+	}
+
+	// the sku of a product matched by id may be changed to one in use
+	if row.SKU != nil && *row.SKU != p.SKU && !created {
+		other, err := app.storage.GetProductBySKU(*row.SKU)
+		if err != nil {
+			return false, nil, err
+		}
+		v.Check(other == nil, "sku", "a product with this sku already exists")
+	}
+	if row.SKU != nil {
+		p.SKU = *row.SKU
+	}
+	if row.Name != nil {
+		p.Name = *row.Name
+	}
+	if row.Description != nil {
+		p.Description = *row.Description
+	}
+	if row.Price != nil {
+		p.Price = *row.Price
+	}
+	if row.Quantity != nil {
+		p.Quantity = *row.Quantity
+	}
+	if row.CategoryIDs != nil {
+		p.CategoryIDs = *row.CategoryIDs
+		for _, id := range p.CategoryIDs {
+			v.Check(categoryIDs[id], "category_ids", "must only contain existing categories")
+		}
+	}
+	if row.Options != nil {
+		v.Check(len(p.Variants) == 0 || slices.Equal(p.Options, *row.Options), "options", "cannot be changed while the product has variants")
+		p.Options = *row.Options
+	}
+	if row.Status != nil {
+		p.SetStatus(*row.Status)
+	}
+	if row.PublishAt != nil {
+		p.PublishAt = row.PublishAt
+	}
+	if row.UnpublishAt != nil {
+		p.UnpublishAt = row.UnpublishAt
+	}
+	v.CheckProduct(p)
+	if v.HasError() || dryRun {
+		return created, v, nil
+	}
+
+	if created {
+		err = app.storage.CreateProduct(p, userID)
+	} else {
+		err = app.storage.UpdateProduct(p, userID)
+	}
+	switch {
+	case errors.Is(err, ErrDuplicateProductSKU):
+		v.Check(false, "sku", "a product with this sku already exists")
+	case errors.Is(err, ErrUnknownCategory):
+		v.Check(false, "category_ids", "must only contain existing categories")
+	case errors.Is(err, sql.ErrNoRows):
+		v.Check(false, "row", "the product was modified during the import")
+	case err != nil:
+		return false, nil, err
+	}
+	return created, v, nil
+}
+
+// runProductImport imports the rows one by one, a rejected row does not stop
+// the import. The progress is saved as it goes.
+func (app *Application) runProductImport(pi *ProductImport, rows []productImportRow) {
+	categories, err := app.storage.GetCategories()
+	if err != nil {
+		app.failProductImport(pi, err)
+		return
+	}
+	categoryIDs := make(map[int64]bool, len(categories))
+	for _, c := range categories {
+		categoryIDs[c.ID] = true
+	}
+
+	pi.Status = ImportRunning
+	err = app.storage.UpdateProductImport(pi)
+	if err != nil {
+		app.failProductImport(pi, err)
+		return
+	}
+
+	for _, row := range rows {
+		created, v := false, row.errs
+		if v == nil {
+			created, v, err = app.importProduct(row, pi.UserID, categoryIDs, pi.DryRun)
+			if err != nil {
+				app.failProductImport(pi, err)
+				return
+			}
+		}
+		pi.ProcessedRows++
+		switch {
+		case v.HasError():
+			pi.FailedRows++
+			if len(pi.Errors) < maxProductImportErrors {
+				pi.Errors = append(pi.Errors, ProductImportError{Row: row.number, Errors: v.violations})
+			}
+		case created:
+			pi.CreatedRows++
+		default:
+			pi.UpdatedRows++
+		}
+		if pi.ProcessedRows%productImportProgressRows == 0 {
+			err = app.storage.UpdateProductImport(pi)
+			if err != nil {
+				log.Printf("product import %d: %v\n", pi.ID, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	pi.Status = ImportCompleted
+	pi.FinishedAt = &now
+	err = app.storage.UpdateProductImport(pi)
+	if err != nil {
+		log.Printf("product import %d: %v\n", pi.ID, err)
+	}
+}
+
+func (app *Application) failProductImport(pi *ProductImport, err error) {
+	log.Printf("product import %d: %v\n", pi.ID, err)
+	now := time.Now()
+	pi.Status = ImportFailed
+	pi.Error = "the import was stopped by an internal error, the rows processed so far were kept"
+	pi.FinishedAt = &now
+	err = app.storage.UpdateProductImport(pi)
+	if err != nil {
+		log.Printf("product import %d: %v\n", pi.ID, err)
+	}
+}
+
+// productWriter writes products in one of productFormats.
+type productWriter interface {
+	Write(p *Product) error
+	Flush() error
+}
+
+func newProductWriter(format string, w io.Writer) (productWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write(productColumns)
+		if err != nil {
+			return nil, err
+		}
+		return &csvProductWriter{w: cw}, nil
+	case "ndjson":
+		return &ndjsonProductWriter{w: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+type csvProductWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvProductWriter) Write(p *Product) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	ids := make([]string, len(p.CategoryIDs))
+	for i, id := range p.CategoryIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	record := []string{
+		strconv.FormatInt(p.ID, 10),
+		p.SKU,
+		p.Name,
+		p.Description,
+		p.Price.String(),
+		strconv.FormatInt(p.Quantity, 10),
+		string(p.Status),
+		formatTime(p.PublishAt),
+		formatTime(p.UnpublishAt),
+		strings.Join(ids, listSeparator),
+		strings.Join(p.Options, listSeparator),
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvProductWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonProductWriter struct {
+	w *bufio.Writer
+}
+
+func (nw *ndjsonProductWriter) Write(p *Product) error {
+	row := productImportRow{
+		ID:          &p.ID,
+		SKU:         &p.SKU,
+		Name:        &p.Name,
+		Description: &p.Description,
+		Price:       &p.Price,
+		Quantity:    &p.Quantity,
+		Status:      &p.Status,
+		PublishAt:   p.PublishAt,
+		UnpublishAt: p.UnpublishAt,
+		CategoryIDs: &p.CategoryIDs,
+		Options:     &p.Options,
+	}
+	return json.NewEncoder(nw.w).Encode(row)
+}
+
+func (nw *ndjsonProductWriter) Flush() error {
+	return nw.w.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// parsedRow sums up a productImportRow: fields is the JSON object of the set
+// fields and errs the errors of a row that could not be parsed, whose fields
+// are not compared.
+type parsedRow struct {
+	number int
+	fields string
+	errs   map[string]string
+}
+
+func summarizeRows(t *testing.T, rows []productImportRow) []parsedRow {
+	t.Helper()
+	summary := make([]parsedRow, len(rows))
+	for i, row := range rows {
+		summary[i].number = row.number
+		if row.errs != nil {
+			summary[i].errs = row.errs.violations
+			continue
+		}
+		// drop the null fields by going through a map, which also sorts them
+		data, err := json.Marshal(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]any{}
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maps.DeleteFunc(fields, func(_ string, v any) bool {
+			return v == nil
+		})
+		data, err = json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary[i].fields = string(data)
+	}
+	return summary
+}
+
+func checkProductRows(t *testing.T, name string, rows []productImportRow, err error, want []parsedRow, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: error = %v, want %q", name, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: unexpected error %v", name, err)
+		return
+	}
+	got := summarizeRows(t, rows)
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d rows %+v, want %d", name, len(got), got, len(want))
+		return
+	}
+	for i := range want {
+		if got[i].number != want[i].number || got[i].fields != want[i].fields || !maps.Equal(got[i].errs, want[i].errs) {
+			t.Errorf("%s: row %d = %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadCSVProductRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		rows  []parsedRow
+		err   string
+	}{
+		{
+			name: "every column",
+			input: "id,sku,name,description,price,quantity,status,publish_at,unpublish_at,category_ids,options\n" +
+				"1,MUG-1,Mug,\"A mug, blue\",10.50,3,draft,2026-01-02T03:04:05Z,,1|2,size| color\n",
+			rows: []parsedRow{
+				{number: 1, fields: `{"category_ids":[1,2],"description":"A mug, blue","id":1,"name":"Mug","options":["size","color"],"price":"10.5","publish_at":"2026-01-02T03:04:05Z","quantity":3,"sku":"MUG-1","status":"draft"}`},
+			},
+		},
+		{
+			name:  "header is case and space insensitive",
+			input: " Name ,PRICE\nMug,2\n",
+			rows:  []parsedRow{{number: 1, fields: `{"name":"Mug","price":"2"}`}},
+		},
+		{
+			name:  "empty cells are left unchanged",
+			input: "id,name,price\n2,, \n",
+			rows:  []parsedRow{{number: 1, fields: `{"id":2}`}},
+		},
+		{
+			name:  "invalid cells",
+			input: "id,price,quantity,publish_at,category_ids\n-1,abc,1.5,yesterday,1|x\n",
+			rows: []parsedRow{{number: 1, errs: map[string]string{
+				"id":           "must be a positive integer",
+				"price":        "must be a number",
+				"quantity":     "must be an integer",
+				"publish_at":   "must be an RFC 3339 timestamp",
+				"category_ids": `must be positive integers separated by "|"`,
+			}}},
+		},
+		{
+			name:  "rows are numbered past rejected ones",
+			input: "name,price\nMug\nCup,3\n",
+			rows: []parsedRow{
+				{number: 1, errs: map[string]string{"row": "must have 2 fields"}},
+				{number: 2, fields: `{"name":"Cup","price":"3"}`},
+			},
+		},
+		{
+			name:  "malformed quotes",
+			input: "name\nM\"ug\n",
+			rows:  []parsedRow{{number: 1, errs: map[string]string{"row": `bare " in non-quoted-field`}}},
+		},
+		{name: "empty file", input: "", err: "file must start with a header row"},
+		{name: "unknown column", input: "name,colour\n", err: `unknown column "colour"`},
+		{name: "duplicate column", input: "name,Name\n", err: `duplicate column "name"`},
+	}
+	for _, tt := range tests {
+		rows, err := readProductImportRows("csv", strings.NewReader(tt.input))
+		checkProductRows(t, tt.name, rows, err, tt.rows, tt.err)
+	}
+}
+
+func TestReadNDJSONProductRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		rows  []parsedRow
+		err   string
+	}{
+		{
+			name: "rows are numbered by line",
+			input: `{"sku": "MUG-1", "price": "10.50", "category_ids": [3], "publish_at": "2026-01-02T03:04:05Z"}` + "\n\n" +
+				`{"id": 4, "name": "Cup", "options": []}` + "\n",
+			rows: []parsedRow{
+				{number: 1, fields: `{"category_ids":[3],"price":"10.5","publish_at":"2026-01-02T03:04:05Z","sku":"MUG-1"}`},
+				{number: 3, fields: `{"id":4,"name":"Cup","options":[]}`},
+			},
+		},
+		{
+			name:  "null fields are left unchanged",
+			input: `{"id": 4, "name": null, "description": null}`,
+			rows:  []parsedRow{{number: 1, fields: `{"id":4}`}},
+		},
+		{
+			name:  "incorrect type",
+			input: `{"quantity": "3"}`,
+			rows:  []parsedRow{{number: 1, errs: map[string]string{"quantity": "has an incorrect JSON type"}}},
+		},
+		{
+			name:  "unknown field",
+			input: `{"colour": "blue"}`,
+			rows:  []parsedRow{{number: 1, errs: map[string]string{"row": "must be a JSON object with the fields " + strings.Join(productColumns, ", ")}}},
+		},
+		{
+			name:  "not json",
+			input: "id,name\n",
+			rows:  []parsedRow{{number: 1, errs: map[string]string{"row": "must be a JSON object with the fields " + strings.Join(productColumns, ", ")}}},
+		},
+		{
+			name:  "line too long",
+			input: `{"description": "` + strings.Repeat("a", 1<<20) + `"}`,
+			err:   "line 1 must not be longer than 1MB",
+		},
+		{
+			name:  "line too long after blank lines",
+			input: "\n" + `{"name": "Mug"}` + "\n\n" + `{"description": "` + strings.Repeat("a", 1<<20) + `"}`,
+			err:   "line 4 must not be longer than 1MB",
+		},
+	}
+	for _, tt := range tests {
+		rows, err := readProductImportRows("ndjson", strings.NewReader(tt.input))
+		checkProductRows(t, tt.name, rows, err, tt.rows, tt.err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidJWT = errors.New("invalid jwt")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtParts struct {
+	header       jwtHeader
+	payload      []byte
+	signingInput string
+	signature    []byte
+}
+
+// decodeJWT splits a compact serialized JWT without verifying it.
+func decodeJWT(token string) (*jwtParts, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errInvalidJWT
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	parts := &jwtParts{
+		payload:      payload,
+		signingInput: segments[0] + "." + segments[1],
+		signature:    signature,
+	}
+	err = json.Unmarshal(headerBytes, &parts.header)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	return parts, nil
+}
+
+func jwtHash(alg string, data string) (crypto.Hash, []byte, error) {
+	switch alg[2:] {
+	case "256":
+		sum := sha256.Sum256([]byte(data))
+		return crypto.SHA256, sum[:], nil
+	case "384":
+		sum := sha512.Sum384([]byte(data))
+		return crypto.SHA384, sum[:], nil
+	case "512":
+		sum := sha512.Sum512([]byte(data))
+		return crypto.SHA512, sum[:], nil
+	}
+	return 0, nil, fmt.Errorf("unsupported jwt algorithm %q", alg)
+}
+
+// verifyJWTSignature checks an asymmetric signature. Symmetric algorithms are
+// handled by the caller because they must never be accepted with a public key.
+func verifyJWTSignature(parts *jwtParts, key crypto.PublicKey) error {
+	alg := parts.header.Alg
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errInvalidJWT
+		}
+		h, digest, err := jwtHash(alg, parts.signingInput)
+		if err != nil {
+			return err
+		}
+		if rsa.VerifyPKCS1v15(k, h, digest, parts.signature) != nil {
+			return errInvalidJWT
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errInvalidJWT
+		}
+		_, digest, err := jwtHash(alg, parts.signingInput)
+		if err != nil {
+			return err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(parts.signature) != 2*size {
+			return errInvalidJWT
+		}
+		r := new(big.Int).SetBytes(parts.signature[:size])
+		s := new(big.Int).SetBytes(parts.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errInvalidJWT
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return errInvalidJWT
+		}
+		if !ed25519.Verify(k, []byte(parts.signingInput), parts.signature) {
+			return errInvalidJWT
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// jwtAudience accepts both forms of the "aud" claim, a string or an array.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// AccessClaims are the claims of the JWT authentication tokens issued by this
+// API. They carry enough of the user to authorize a request without a
+// database lookup.
+type AccessClaims struct {
+	Issuer      string      `json:"iss"`
+	Subject     string      `json:"sub"`
+	IssuedAt    int64       `json:"iat"`
+	ExpiresAt   int64       `json:"exp"`
+	ID          string      `json:"jti"`
+	SessionID   int64       `json:"sid"`
+	IsActivated bool        `json:"act"`
+	Permissions Permissions `json:"perms"`
+}
+
+func (c *AccessClaims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+type jwtKey struct {
+	id      string
+	alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// JWTSigner signs and verifies authentication tokens. The first key signs new
+// tokens, the others are only used to verify tokens issued before a rotation.
+type JWTSigner struct {
+	issuer string
+	active *jwtKey
+	keys   map[string]*jwtKey
+}
+
+// NewJWTSigner parses a comma separated list of keys in the form
+// "kid:alg:base64-key". alg is HS256 with a secret of at least 32 bytes or
+// EdDSA with a 32 byte ed25519 seed.
+func NewJWTSigner(issuer, spec string) (*JWTSigner, error) {
+	s := &JWTSigner{
+		issuer: issuer,
+		keys:   make(map[string]*jwtKey),
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.SplitN(item, ":", 3)
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("jwt key %q: must be in the form kid:alg:base64-key", item)
+		}
+		kid, alg := fields[0], fields[1]
+		material, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", kid, err)
+		}
+		k := &jwtKey{id: kid, alg: alg}
+		switch alg {
+		case "HS256":
+			if len(material) < 32 {
+				return nil, fmt.Errorf("jwt key %q: HS256 secrets must be at least 32 bytes", kid)
+			}
+			k.secret = material
+		case "EdDSA":
+			if len(material) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwt key %q: EdDSA keys must be a %d byte seed", kid, ed25519.SeedSize)
+			}
+			k.private = ed25519.NewKeyFromSeed(material)
+			k.public = k.private.Public().(ed25519.PublicKey)
+		default:
+			return nil, fmt.Errorf("jwt key %q: unsupported algorithm %q", kid, alg)
+		}
+		if _, ok := s.keys[kid]; ok {
+			return nil, fmt.Errorf("jwt key %q: duplicate key id", kid)
+		}
+		s.keys[kid] = k
+		if s.active == nil {
+			s.active = k
+		}
+	}
+	if s.active == nil {
+		return nil, errors.New("at least one jwt key must be configured")
+	}
+	return s, nil
+}
+
+// Sign fills in the issuer, issue time and id of the claims and returns the
+// signed token.
+func (s *JWTSigner) Sign(claims *AccessClaims) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+	claims.Issuer = s.issuer
+	claims.IssuedAt = time.Now().Unix()
+	claims.ID = base64.RawURLEncoding.EncodeToString(jti)
+
+	header, err := json.Marshal(jwtHeader{Alg: s.active.alg, Kid: s.active.id, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch s.active.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, s.active.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case "EdDSA":
+		signature = ed25519.Sign(s.active.private, []byte(signingInput))
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature, issuer and expiry of the token. The algorithm
+// of the token must match the one configured for its key.
+func (s *JWTSigner) Verify(token string) (*AccessClaims, error) {
+	parts, err := decodeJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := s.keys[parts.header.Kid]
+	if !ok || parts.header.Alg != k.alg {
+		return nil, errInvalidJWT
+	}
+
+	switch k.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(parts.signingInput))
+		if !hmac.Equal(mac.Sum(nil), parts.signature) {
+			return nil, errInvalidJWT
+		}
+	case "EdDSA":
+		err = verifyJWTSignature(parts, k.public)
+		if err != nil {
+			return nil, errInvalidJWT
+		}
+	}
+
+	var claims AccessClaims
+	err = json.Unmarshal(parts.payload, &claims)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	if claims.Issuer != s.issuer || claims.SessionID == 0 {
+		return nil, errInvalidJWT
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errInvalidJWT
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, errInvalidJWT
+	}
+	return &claims, nil
+}
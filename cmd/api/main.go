@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -43,13 +44,48 @@ type Config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	oidc struct {
+		providersFile string
+	}
+	tokens struct {
+		authenticationTTL time.Duration
+		refreshTTL        time.Duration
+		format            string
+	}
+	jwt struct {
+		keys              string
+		issuer            string
+		revocationRefresh time.Duration
+	}
+	cache struct {
+		permissionsTTL time.Duration
+	}
+	users struct {
+		deletionGracePeriod time.Duration
+	}
+	images struct {
+		backend string
+		dir     string
+		baseURL string
+		maxSize int64
+	}
+	lockout struct {
+		freeFailures int
+		maxFailures  int
+		maxDelay     time.Duration
+		duration     time.Duration
+	}
 }
 
 type Application struct {
-	config  Config
-	storage *Storage
-	mailer  *Mailer
-	wg      sync.WaitGroup
+	config            Config
+	storage           *Storage
+	mailer            *Mailer
+	identityProviders map[string]IdentityProvider
+	jwt               *JWTSigner
+	images            ImageStore
+	revoked           *RevocationList
+	wg                sync.WaitGroup
 }
 
 const (
@@ -94,6 +130,30 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate Limiter max burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	flag.DurationVar(&cfg.tokens.authenticationTTL, "auth-token-ttl", 15*time.Minute, "Lifetime of authentication tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.tokens.format, "auth-token-format", "opaque", "Format of authentication tokens (opaque|jwt)")
+
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", os.Getenv("JWT_KEYS"), "JWT keys as kid:alg:base64-key separated by commas, the first one signs new tokens")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "simple-ecommerce-api", "Issuer of JWT authentication tokens")
+	flag.DurationVar(&cfg.jwt.revocationRefresh, "jwt-revocation-refresh", 5*time.Second, "Interval between reloads of the revoked sessions list")
+
+	flag.DurationVar(&cfg.cache.permissionsTTL, "permissions-cache-ttl", time.Minute, "Lifetime of cached user permissions (0 disables the cache)")
+
+	flag.IntVar(&cfg.lockout.freeFailures, "lockout-free-failures", 3, "Failed logins per account before login attempts are delayed")
+	flag.IntVar(&cfg.lockout.maxFailures, "lockout-max-failures", 10, "Failed logins per account before the account is temporarily locked")
+	flag.DurationVar(&cfg.lockout.maxDelay, "lockout-max-delay", time.Minute, "Maximum delay between login attempts of an account")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", 15*time.Minute, "Duration of a temporary account lockout")
+
+	flag.DurationVar(&cfg.users.deletionGracePeriod, "user-deletion-grace-period", 30*24*time.Hour, "Time a deleted user can be restored before being anonymized")
+
+	flag.StringVar(&cfg.images.backend, "images-backend", "local", "Storage backend of product images (local)")
+	flag.StringVar(&cfg.images.dir, "images-dir", "./uploads", "Directory of product images for the local backend")
+	flag.StringVar(&cfg.images.baseURL, "images-base-url", "/images", "Base URL product image keys are appended to")
+	flag.Int64Var(&cfg.images.maxSize, "images-max-size", 5<<20, "Maximum size of an uploaded product image in bytes")
+
+	flag.StringVar(&cfg.oidc.providersFile, "oidc-providers", os.Getenv("OIDC_PROVIDERS_FILE"), "Path to a JSON file with the OpenID Connect providers")
+
 	var trustedOrigins string
 	flag.StringVar(&trustedOrigins, "cors-trusted-origins", "*", "Trusted CORS origins saperated by space")
 
@@ -109,6 +169,10 @@ func main() {
 
 	cfg.cors.trustedOrigins = strings.Fields(trustedOrigins)
 
+	if cfg.tokens.format != "opaque" && cfg.tokens.format != "jwt" {
+		log.Fatalf(`invalid value %s for flag "auth-token-format"`, cfg.tokens.format)
+	}
+
 	queryTimeout := 5 * time.Second
 	storage, err := NewStorage(cfg, queryTimeout)
 	if err != nil {
@@ -117,10 +181,42 @@ func main() {
 
 	log.Println("Connected to database")
 
+	expvar.Publish("permissions_cache", expvar.Func(func() any {
+		return storage.permissions.Stats()
+	}))
+
+	identityProviders, err := LoadIdentityProviders(cfg.oidc.providersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	images, err := NewImageStore(cfg.images.backend, cfg.images.dir, cfg.images.baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	app := &Application{
-		config:  cfg,
-		storage: storage,
-		mailer:  NewMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:            cfg,
+		storage:           storage,
+		mailer:            NewMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		identityProviders: identityProviders,
+		images:            images,
+		revoked:           NewRevocationList(),
+	}
+
+	if cfg.tokens.format == "jwt" {
+		app.jwt, err = NewJWTSigner(cfg.jwt.issuer, cfg.jwt.keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		revoked, err := storage.GetRevokedSessions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.revoked.Replace(revoked)
+		expvar.Publish("revoked_sessions", expvar.Func(func() any {
+			return app.revoked.Len()
+		}))
 	}
 
 	tlsConfig := &tls.Config{
@@ -179,6 +275,78 @@ func main() {
 		}
 	}()
 
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			select {
+			case <-done:
+				log.Println("Users background goroutine was shutdown gracefully")
+				return
+			case <-ticker.C:
+				n, err := app.storage.AnonymizeDeletedUsers(cfg.users.deletionGracePeriod)
+				if err != nil {
+					log.Println("Users goroutine: ", err)
+				} else {
+					log.Printf("Users goroutine: anonymized %d users", n)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for {
+			select {
+			case <-done:
+				log.Println("Products background goroutine was shutdown gracefully")
+				return
+			case <-ticker.C:
+				published, archived, err := app.storage.ApplyProductSchedules()
+				if err != nil {
+					log.Println("Products goroutine: ", err)
+				} else if published > 0 || archived > 0 {
+					log.Printf("Products goroutine: published %d and archived %d products", published, archived)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		for {
+			select {
+			case <-done:
+				log.Println("Search background goroutine was shutdown gracefully")
+				return
+			case <-ticker.C:
+				err := app.storage.RefreshProductWords()
+				if err != nil {
+					log.Println("Search goroutine: ", err)
+				}
+			}
+		}
+	}()
+
+	if app.jwt != nil {
+		go func() {
+			ticker := time.NewTicker(cfg.jwt.revocationRefresh)
+			for {
+				select {
+				case <-done:
+					log.Println("Revocations background goroutine was shutdown gracefully")
+					return
+				case <-ticker.C:
+					revoked, err := app.storage.GetRevokedSessions()
+					if err != nil {
+						log.Println("Revocations goroutine: ", err)
+					} else {
+						app.revoked.Replace(revoked)
+					}
+				}
+			}
+		}()
+	}
+
 	log.Printf("Starting server on port: %d\n", cfg.port)
 
 	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
@@ -17,16 +17,44 @@ import (
 type userContextKey string
 
 const (
-	UserContextKey userContextKey = "USER_CONTEXT_KEY"
+	UserContextKey   userContextKey = "USER_CONTEXT_KEY"
+	TokenContextKey  userContextKey = "TOKEN_CONTEXT_KEY"
+	APIKeyContextKey userContextKey = "API_KEY_CONTEXT_KEY"
+	ClaimsContextKey userContextKey = "CLAIMS_CONTEXT_KEY"
 )
 
 func getUserFromRequest(r *http.Request) *User {
 	return r.Context().Value(UserContextKey).(*User)
 }
 
+func getTokenFromRequest(r *http.Request) *Token {
+	return r.Context().Value(TokenContextKey).(*Token)
+}
+
+// getAPIKeyFromRequest returns the API key the request was authenticated with,
+// or nil when it was authenticated with a token.
+func getAPIKeyFromRequest(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(APIKeyContextKey).(*APIKey)
+	return k
+}
+
+// getClaimsFromRequest returns the claims of the JWT the request was
+// authenticated with, or nil when it was authenticated otherwise.
+func getClaimsFromRequest(r *http.Request) *AccessClaims {
+	c, _ := r.Context().Value(ClaimsContextKey).(*AccessClaims)
+	return c
+}
+
+var ErrUserSuspended = errors.New("your account has been suspended")
+
 func (app *Application) authenticate(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			app.authenticateAPIKey(key, next, w, r)
+			return
+		}
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			writeError(errors.New("invalid Authorization header"), http.StatusUnauthorized, w)
@@ -39,41 +67,189 @@ func (app *Application) authenticate(next http.HandlerFunc) http.HandlerFunc {
 		}
 		token := parts[1]
 
+		if app.jwt != nil && strings.Count(token, ".") == 2 {
+			app.authenticateJWT(token, next, w, r)
+			return
+		}
+
 		v := NewValidator()
-		v.Check(token != "", "token", "must be provided")
-		v.Check(len(token) == base32.StdEncoding.WithPadding(base32.NoPadding).EncodedLen(16), "token", "must be valid")
+		v.CheckToken(token)
 
 		if v.HasError() {
 			writeError(errors.New("invalid token"), http.StatusUnauthorized, w)
 			return
 		}
 
-		u, err := app.storage.GetUserFromToken(token, ScopeAuthentication)
+		u, t, err := app.storage.GetUserFromAuthenticationToken(token)
 		if err != nil {
+			writeServerError(w)
+			return
+		}
+		if u == nil {
 			writeError(errors.New("invalid token"), http.StatusUnauthorized, w)
 			return
 		}
+		if u.SuspendedAt != nil {
+			writeError(ErrUserSuspended, http.StatusForbidden, w)
+			return
+		}
 
 		ctx := context.WithValue(r.Context(), UserContextKey, u)
+		ctx = context.WithValue(ctx, TokenContextKey, t)
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	}
 }
 
+// authenticateJWT validates a JWT authentication token without a database
+// lookup. The user in the context only has the id and activation state, routes
+// that need the whole user go through requireSession which loads it.
+func (app *Application) authenticateJWT(token string, next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	claims, err := app.jwt.Verify(token)
+	if err != nil {
+		writeError(errors.New("invalid token"), http.StatusUnauthorized, w)
+		return
+	}
+	if app.revoked.IsRevoked(claims.SessionID) {
+		writeError(errors.New("invalid token"), http.StatusUnauthorized, w)
+		return
+	}
+
+	userID, _ := claims.UserID()
+	u := &User{
+		ID:          userID,
+		IsActivated: claims.IsActivated,
+	}
+	t := &Token{
+		Text:      token,
+		UserID:    userID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		Scope:     ScopeAuthentication,
+		FamilyID:  claims.SessionID,
+	}
+
+	ctx := context.WithValue(r.Context(), UserContextKey, u)
+	ctx = context.WithValue(ctx, TokenContextKey, t)
+	ctx = context.WithValue(ctx, ClaimsContextKey, claims)
+	r = r.WithContext(ctx)
+
+	next.ServeHTTP(w, r)
+}
+
+func (app *Application) authenticateAPIKey(key string, next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+base32.StdEncoding.WithPadding(base32.NoPadding).EncodedLen(32) {
+		writeError(errors.New("invalid api key"), http.StatusUnauthorized, w)
+		return
+	}
+
+	u, k, err := app.storage.GetUserFromAPIKey(key)
+	if err != nil {
+		writeServerError(w)
+		return
+	}
+	if u == nil {
+		writeError(errors.New("invalid api key"), http.StatusUnauthorized, w)
+		return
+	}
+	if u.SuspendedAt != nil {
+		writeError(ErrUserSuspended, http.StatusForbidden, w)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), UserContextKey, u)
+	ctx = context.WithValue(ctx, TokenContextKey, (*Token)(nil))
+	ctx = context.WithValue(ctx, APIKeyContextKey, k)
+	r = r.WithContext(ctx)
+
+	next.ServeHTTP(w, r)
+}
+
+// requireSession rejects requests authenticated with an API key. API keys only
+// reach routes guarded by requirePermission, everything else acts on the
+// account itself and needs a user session. For JWT authentication tokens the
+// whole user is loaded here since the claims only carry part of it.
+func (app *Application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getAPIKeyFromRequest(r) != nil {
+			writeError(errors.New("this resource is not available to api keys"), http.StatusForbidden, w)
+			return
+		}
+		if getClaimsFromRequest(r) != nil {
+			u, err := app.storage.GetUserById(getUserFromRequest(r).ID)
+			if err != nil {
+				writeServerError(w)
+				return
+			}
+			if u == nil {
+				writeError(errors.New("invalid token"), http.StatusUnauthorized, w)
+				return
+			}
+			if u.SuspendedAt != nil {
+				writeError(ErrUserSuspended, http.StatusForbidden, w)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), UserContextKey, u))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authenticateOptional authenticates the requests carrying credentials and
+// lets the others through anonymously, with a nil user in the context.
+func (app *Application) authenticateOptional(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := app.authenticate(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+			authenticated(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+		ctx := context.WithValue(r.Context(), UserContextKey, (*User)(nil))
+		ctx = context.WithValue(ctx, TokenContextKey, (*Token)(nil))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// hasPermission tells whether the user of the request, and its API key if it
+// used one, has the permission. Anonymous requests have none.
+func (app *Application) hasPermission(r *http.Request, code string) (bool, error) {
+	u := getUserFromRequest(r)
+	if u == nil {
+		return false, nil
+	}
+	var permissions Permissions
+	if claims := getClaimsFromRequest(r); claims != nil {
+		permissions = claims.Permissions
+	} else {
+		var err error
+		permissions, err = app.storage.GetUserPermissions(u.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !permissions.Has(code) {
+		return false, nil
+	}
+	if k := getAPIKeyFromRequest(r); k != nil && !k.Permissions.Has(code) {
+		return false, nil
+	}
+	return true, nil
+}
+
 func (app *Application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		u := getUserFromRequest(r)
-		if u == nil {
+		if getUserFromRequest(r) == nil {
 			writeServerError(w)
 			return
 		}
-		permissions, err := app.storage.GetUserPermissions(u.ID)
+		ok, err := app.hasPermission(r, code)
 		if err != nil {
 			writeServerError(w)
 			return
 		}
-		if !permissions.Has(code) {
+		if !ok {
 			writeForbidden(w)
 			return
 		}
@@ -159,7 +335,7 @@ func (app *Application) enableCORS(next http.Handler) http.HandlerFunc {
 					// preflight request
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
 						w.WriteHeader(http.StatusOK)
 						return
 					}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExternalIdentity is what an identity provider vouches for after a successful
+// login.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// canLinkByEmail reports whether the identity may be linked to the account
+// with the same email, or create one: only an email the provider verified is
+// trusted.
+func (i *ExternalIdentity) canLinkByEmail() bool {
+	return i.Email != "" && i.EmailVerified
+}
+
+// IdentityProvider is implemented by every external login provider. The
+// OpenID Connect implementation below is configured from a file, so a local
+// stand-in issuer can be used by pointing the issuer URL at it.
+type IdentityProvider interface {
+	AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error)
+	Authenticate(ctx context.Context, code, codeVerifier, nonce string) (*ExternalIdentity, error)
+}
+
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OIDCProvider struct {
+	config OIDCProviderConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+const (
+	oidcClockSkew       = time.Minute
+	oidcMinKeysInterval = time.Minute
+)
+
+func NewOIDCProvider(cfg OIDCProviderConfig, client *http.Client) *OIDCProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{
+		config: cfg,
+		client: client,
+	}
+}
+
+// LoadIdentityProviders reads a JSON array of OIDCProviderConfig from path.
+func LoadIdentityProviders(path string) (map[string]IdentityProvider, error) {
+	providers := make(map[string]IdentityProvider)
+	if path == "" {
+		return providers, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []OIDCProviderConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity providers file %s: %w", path, err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("identity provider %q must have a name, issuer, client_id and redirect_url", cfg.Name)
+		}
+		if _, ok := providers[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate identity provider %q", cfg.Name)
+		}
+		providers[cfg.Name] = NewOIDCProvider(cfg, client)
+	}
+	return providers, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", endpoint, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
+
+func (p *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	endpoint := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	var d oidcDiscovery
+	err := p.getJSON(ctx, endpoint, &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %q but discovered %q", p.config.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// getKey returns the signing key with the given id, refetching the JWKS when
+// the id is unknown (the provider may have rotated its keys).
+func (p *OIDCProvider) getKey(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcMinKeysInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := p.getJSON(ctx, jwksURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	p.keysFetchedAt = time.Now()
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+func (p *OIDCProvider) exchange(ctx context.Context, tokenEndpoint, code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint did not return an id_token")
+	}
+	return body.IDToken, nil
+}
+
+type oidcClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      jwtAudience `json:"aud"`
+	AuthorizedBy  string      `json:"azp"`
+	ExpiresAt     int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified any         `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw, nonce string) (*oidcClaims, error) {
+	parts, err := decodeJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	allowed := []string{"RS256", "RS384", "RS512", "ES256", "ES384"}
+	if !slices.Contains(allowed, parts.header.Alg) {
+		return nil, fmt.Errorf("unsupported id_token algorithm %q", parts.header.Alg)
+	}
+	key, err := p.getKey(ctx, d.JWKSURI, parts.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(parts, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims oidcClaims
+	err = json.Unmarshal(parts.payload, &claims)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, errors.New("id_token has an unexpected issuer")
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, errors.New("id_token was not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, errors.New("id_token was not authorized for this client")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return nil, errors.New("id_token is expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("id_token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("id_token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("id_token is missing the subject")
+	}
+	return &claims, nil
+}
+
+func (p *OIDCProvider) Authenticate(ctx context.Context, code, codeVerifier, nonce string) (*ExternalIdentity, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := p.exchange(ctx, d.TokenEndpoint, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(ctx, d, raw, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// some providers encode email_verified as a string
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+
+	identity := &ExternalIdentity{
+		Provider:      p.config.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}
+	return identity, nil
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
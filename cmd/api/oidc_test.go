@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a stand-in OpenID Connect provider serving the discovery
+// document, its JWKS and a token endpoint returning idToken.
+type testIssuer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	keys       map[string]*rsa.PrivateKey
+	keyFetches int
+	idToken    string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{keys: map[string]*rsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                iss.URL,
+			AuthorizationEndpoint: iss.URL + "/authorize",
+			TokenEndpoint:         iss.URL + "/token",
+			JWKSURI:               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		iss.keyFetches++
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range iss.keys {
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(jwks)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": iss.idToken})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys[kid] = key
+}
+
+// sign returns an id_token with the given claims, signed by the key kid with
+// RS256 or by a shared secret with HS256.
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		iss.mu.Lock()
+		key := iss.keys[kid]
+		iss.mu.Unlock()
+		sum := sha256.Sum256([]byte(input))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte("client-secret"))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (iss *testIssuer) authenticate(p *OIDCProvider, token, nonce string) (*ExternalIdentity, error) {
+	iss.mu.Lock()
+	iss.idToken = token
+	iss.mu.Unlock()
+	return p.Authenticate(context.Background(), "code", "verifier", nonce)
+}
+
+func newTestProvider(iss *testIssuer) *OIDCProvider {
+	return NewOIDCProvider(OIDCProviderConfig{
+		Name:         "test",
+		Issuer:       iss.URL,
+		ClientID:     "client",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost/v1/auth/test/callback",
+	}, iss.Client())
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "k1")
+	p := newTestProvider(iss)
+
+	now := time.Now()
+	claims := func(change func(c map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   iss.URL,
+			"sub":   "42",
+			"aud":   "client",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "nonce",
+			"email": "jane@example.com",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	// tamper keeps the signature of token on the claims of forged
+	tamper := func(token, forged string) string {
+		return forged[:strings.LastIndex(forged, ".")] + token[strings.LastIndex(token, "."):]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", iss.sign(t, "RS256", "k1", claims(nil)), ""},
+		{"several audiences", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["aud"] = []string{"other", "client"}
+			c["azp"] = "client"
+		})), ""},
+		{"wrong audience", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["aud"] = "other"
+		})), "not issued for this client"},
+		{"wrong authorized party", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["aud"] = []string{"client", "other"}
+			c["azp"] = "other"
+		})), "not authorized for this client"},
+		{"wrong issuer", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["iss"] = "https://issuer.example.com"
+		})), "unexpected issuer"},
+		{"wrong nonce", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["nonce"] = "replayed"
+		})), "nonce mismatch"},
+		{"expired", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["exp"] = now.Add(-oidcClockSkew - time.Minute).Unix()
+		})), "expired"},
+		{"expired within the clock skew", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["exp"] = now.Add(-oidcClockSkew / 2).Unix()
+		})), ""},
+		{"issued in the future", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["iat"] = now.Add(oidcClockSkew + time.Minute).Unix()
+		})), "issued in the future"},
+		{"missing subject", iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			delete(c, "sub")
+		})), "missing the subject"},
+		{"hmac signed with the client secret", iss.sign(t, "HS256", "k1", claims(nil)), `unsupported id_token algorithm "HS256"`},
+		{"unsigned", iss.sign(t, "none", "k1", claims(nil)), `unsupported id_token algorithm "none"`},
+		{"tampered", tamper(iss.sign(t, "RS256", "k1", claims(nil)), iss.sign(t, "RS256", "k1", claims(func(c map[string]any) {
+			c["sub"] = "1"
+		}))), "invalid jwt"},
+	}
+	for _, tt := range tests {
+		identity, err := iss.authenticate(p, tt.token, "nonce")
+		if tt.err == "" {
+			if err != nil || identity.Subject != "42" || identity.Provider != "test" {
+				t.Errorf("%s: Authenticate = %+v, %v, want subject 42", tt.name, identity, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Authenticate error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "k1")
+	p := newTestProvider(iss)
+	claims := map[string]any{
+		"iss":   iss.URL,
+		"sub":   "42",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "nonce",
+	}
+
+	_, err := iss.authenticate(p, iss.sign(t, "RS256", "k1", claims), "nonce")
+	if err != nil || iss.keyFetches != 1 {
+		t.Fatalf("first login: error = %v after %d JWKS fetches, want 1", err, iss.keyFetches)
+	}
+
+	// a token signed by a key that was just rotated in is refused until the
+	// JWKS may be fetched again
+	iss.addKey(t, "k2")
+	_, err = iss.authenticate(p, iss.sign(t, "RS256", "k2", claims), "nonce")
+	if err == nil || !strings.Contains(err.Error(), `unknown signing key "k2"`) || iss.keyFetches != 1 {
+		t.Fatalf("throttled refetch: error = %v after %d JWKS fetches, want an unknown key after 1", err, iss.keyFetches)
+	}
+
+	p.mu.Lock()
+	p.keysFetchedAt = time.Now().Add(-oidcMinKeysInterval)
+	p.mu.Unlock()
+	_, err = iss.authenticate(p, iss.sign(t, "RS256", "k2", claims), "nonce")
+	if err != nil || iss.keyFetches != 2 {
+		t.Fatalf("refetch: error = %v after %d JWKS fetches, want 2", err, iss.keyFetches)
+	}
+
+	// known keys are served from the cache
+	_, err = iss.authenticate(p, iss.sign(t, "RS256", "k1", claims), "nonce")
+	if err != nil || iss.keyFetches != 2 {
+		t.Fatalf("cached key: error = %v after %d JWKS fetches, want 2", err, iss.keyFetches)
+	}
+}
+
+func TestOIDCEmailVerified(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addKey(t, "k1")
+	p := newTestProvider(iss)
+
+	tests := []struct {
+		name     string
+		email    string
+		verified any
+		link     bool
+	}{
+		{"verified", "jane@example.com", true, true},
+		{"verified as a string", "jane@example.com", "true", true},
+		{"not verified", "jane@example.com", false, false},
+		{"not verified as a string", "jane@example.com", "false", false},
+		{"unknown", "jane@example.com", nil, false},
+		{"no email", "", true, false},
+	}
+	for _, tt := range tests {
+		claims := map[string]any{
+			"iss":   iss.URL,
+			"sub":   "42",
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "nonce",
+			"email": tt.email,
+		}
+		if tt.verified != nil {
+			claims["email_verified"] = tt.verified
+		}
+		identity, err := iss.authenticate(p, iss.sign(t, "RS256", "k1", claims), "nonce")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if got := identity.canLinkByEmail(); got != tt.link {
+			t.Errorf("%s: canLinkByEmail = %t, want %t", tt.name, got, tt.link)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "net/http"
+import (
+	"expvar"
+	"net/http"
+)
 
 func ComposeRoutes(app *Application) http.Handler {
 	mux := http.NewServeMux()
@@ -8,38 +11,107 @@ func ComposeRoutes(app *Application) http.Handler {
 	fs := http.FileServer(http.Dir("./public"))
 	mux.Handle("GET /static/", http.StripPrefix("/static/", fs))
 
+	if app.config.images.backend == "local" {
+		images := http.FileServer(http.Dir(app.config.images.dir))
+		prefix := localImagesPath(app.config.images.baseURL)
+		mux.Handle("GET "+prefix, http.StripPrefix(prefix, images))
+	}
+
 	mux.HandleFunc("GET /v1/healthcheck", app.healthCheckHandler)
+	mux.HandleFunc("GET /debug/vars", app.authenticate(app.requireUserActivation(app.requirePermission("metrics:read", expvar.Handler().ServeHTTP))))
 
 	mux.HandleFunc("POST /v1/users", app.createUserHandler)
-	mux.HandleFunc("GET /v1/users/{id}", app.authenticate(app.requireUserActivation(app.getUserHandler)))
-	mux.HandleFunc("PUT /v1/users/{id}", app.authenticate(app.requireUserActivation(app.updateUserHandler)))
-	mux.HandleFunc("DELETE /v1/users/{id}", app.authenticate(app.requireUserActivation(app.deleteUserHandler)))
+	mux.HandleFunc("GET /v1/users/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.getUserHandler))))
+	mux.HandleFunc("PUT /v1/users/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.updateUserHandler))))
+	mux.HandleFunc("DELETE /v1/users/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteUserHandler))))
+	mux.HandleFunc("GET /v1/users/{id}/export", app.authenticate(app.requireSession(app.requireUserActivation(app.exportUserHandler))))
+	mux.HandleFunc("POST /v1/users/restore", app.restoreUserHandler)
+	mux.HandleFunc("PUT /v1/users/password", app.updateUserPasswordHandler)
+	mux.HandleFunc("PUT /v1/users/email", app.confirmEmailChangeHandler)
+	mux.HandleFunc("PUT /v1/users/email/revert", app.revertEmailChangeHandler)
+	mux.HandleFunc("POST /v1/users/{id}/totp", app.authenticate(app.requireSession(app.requireUserActivation(app.createTOTPHandler))))
+	mux.HandleFunc("PUT /v1/users/{id}/totp", app.authenticate(app.requireSession(app.requireUserActivation(app.enableTOTPHandler))))
+	mux.HandleFunc("DELETE /v1/users/{id}/totp", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteTOTPHandler))))
+	mux.HandleFunc("GET /v1/users/{id}/sessions", app.authenticate(app.requireSession(app.requireUserActivation(app.getSessionsHandler))))
+	mux.HandleFunc("DELETE /v1/users/{id}/sessions", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteOtherSessionsHandler))))
+	mux.HandleFunc("DELETE /v1/users/{id}/sessions/{session_id}", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteSessionHandler))))
+	mux.HandleFunc("GET /v1/users/{id}/api-keys", app.authenticate(app.requireSession(app.requireUserActivation(app.getAPIKeysHandler))))
+	mux.HandleFunc("POST /v1/users/{id}/api-keys", app.authenticate(app.requireSession(app.requireUserActivation(app.createAPIKeyHandler))))
+	mux.HandleFunc("DELETE /v1/users/{id}/api-keys/{key_id}", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteAPIKeyHandler))))
 
 	mux.HandleFunc("POST /v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	mux.HandleFunc("DELETE /v1/tokens/authentication", app.authenticate(app.requireSession(app.deleteAuthenticationTokenHandler)))
+	mux.HandleFunc("GET /v1/oauth/{provider}/authorize", app.oauthAuthorizeHandler)
+	mux.HandleFunc("GET /v1/oauth/{provider}/callback", app.oauthCallbackHandler)
+	mux.HandleFunc("POST /v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	mux.HandleFunc("POST /v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
 	mux.HandleFunc("POST /v1/tokens/activation", app.createUserActivationTokenHandler)
 	mux.HandleFunc("PUT /v1/tokens/activation", app.activateUserHandler)
+	mux.HandleFunc("POST /v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
 	mux.HandleFunc("POST /v1/products", app.authenticate(app.requireUserActivation(app.requirePermission("products:create", app.createProductHandler))))
-	mux.HandleFunc("GET /v1/products", app.getProductsHandler)
-	mux.HandleFunc("GET /v1/products/{id}", app.getProductHandler)
+	mux.HandleFunc("GET /v1/products", app.authenticateOptional(app.getProductsHandler))
+	mux.HandleFunc("POST /v1/products/import", app.authenticate(app.requireUserActivation(app.requirePermission("products:create", app.requirePermission("products:update", app.importProductsHandler)))))
+	mux.HandleFunc("GET /v1/product-imports/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.getProductImportHandler))))
+	mux.HandleFunc("GET /v1/products/export", app.authenticate(app.requireUserActivation(app.requirePermission("products:read", app.exportProductsHandler))))
+	mux.HandleFunc("GET /v1/products/suggest", app.authenticateOptional(app.suggestProductsHandler))
+	mux.HandleFunc("GET /v1/products/{id}", app.authenticateOptional(app.getProductHandler))
 	mux.HandleFunc("PUT /v1/products/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.updateProductHandler))))
 	mux.HandleFunc("DELETE /v1/products/{id}", app.authenticate(app.requirePermission("products:delete", app.deleteProductHandler)))
+	mux.HandleFunc("GET /v1/products/{id}/history", app.authenticate(app.requireUserActivation(app.requirePermission("products:read", app.getProductHistoryHandler))))
+	mux.HandleFunc("GET /v1/products/{id}/variants", app.authenticateOptional(app.getProductVariantsHandler))
+	mux.HandleFunc("POST /v1/products/{id}/variants", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.createProductVariantHandler))))
+	mux.HandleFunc("PUT /v1/products/{id}/variants/{variant_id}", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.updateProductVariantHandler))))
+	mux.HandleFunc("DELETE /v1/products/{id}/variants/{variant_id}", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.deleteProductVariantHandler))))
+	mux.HandleFunc("GET /v1/products/{id}/images", app.authenticateOptional(app.getProductImagesHandler))
+	mux.HandleFunc("POST /v1/products/{id}/images", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.createProductImageHandler))))
+	mux.HandleFunc("PUT /v1/products/{id}/images", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.reorderProductImagesHandler))))
+	mux.HandleFunc("DELETE /v1/products/{id}/images/{image_id}", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.deleteProductImageHandler))))
+
+	mux.HandleFunc("PUT /v1/products/{id}/attributes", app.authenticate(app.requireUserActivation(app.requirePermission("products:update", app.updateProductAttributesHandler))))
 
-	mux.HandleFunc("POST /v1/cart-items", app.authenticate(app.requireUserActivation(app.createCartItemHandler)))
-	mux.HandleFunc("GET /v1/cart-items", app.authenticate(app.requireUserActivation(app.getCartItems)))
-	mux.HandleFunc("GET /v1/cart-items/{id}", app.authenticate(app.requireUserActivation(app.getCartItem)))
-	mux.HandleFunc("PUT /v1/cart-items/{id}", app.authenticate(app.requireUserActivation(app.updateCartItem)))
-	mux.HandleFunc("DELETE /v1/cart-items", app.authenticate(app.requireUserActivation(app.deleteCartItems)))
-	mux.HandleFunc("DELETE /v1/cart-items/{id}", app.authenticate(app.requireUserActivation(app.deleteCartItem)))
-	mux.HandleFunc("POST /v1/cart-items/checkout", app.authenticate(app.requireUserActivation(app.checkoutHandler)))
+	mux.HandleFunc("GET /v1/attributes", app.getAttributesHandler)
+	mux.HandleFunc("GET /v1/attributes/{id}", app.getAttributeHandler)
+	mux.HandleFunc("POST /v1/attributes", app.authenticate(app.requireUserActivation(app.requirePermission("attributes:create", app.createAttributeHandler))))
+	mux.HandleFunc("PUT /v1/attributes/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("attributes:update", app.updateAttributeHandler))))
+	mux.HandleFunc("DELETE /v1/attributes/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("attributes:delete", app.deleteAttributeHandler))))
 
-	mux.HandleFunc("POST /v1/balances", app.authenticate(app.requireUserActivation(app.addToBalanceHandler)))
+	mux.HandleFunc("GET /v1/categories", app.getCategoriesHandler)
+	mux.HandleFunc("GET /v1/categories/{id}", app.getCategoryHandler)
+	mux.HandleFunc("POST /v1/categories", app.authenticate(app.requireUserActivation(app.requirePermission("categories:create", app.createCategoryHandler))))
+	mux.HandleFunc("PUT /v1/categories/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("categories:update", app.updateCategoryHandler))))
+	mux.HandleFunc("DELETE /v1/categories/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("categories:delete", app.deleteCategoryHandler))))
+
+	mux.HandleFunc("POST /v1/cart-items", app.authenticate(app.requireSession(app.requireUserActivation(app.createCartItemHandler))))
+	mux.HandleFunc("GET /v1/cart-items", app.authenticate(app.requireSession(app.requireUserActivation(app.getCartItems))))
+	mux.HandleFunc("GET /v1/cart-items/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.getCartItem))))
+	mux.HandleFunc("PUT /v1/cart-items/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.updateCartItem))))
+	mux.HandleFunc("DELETE /v1/cart-items", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteCartItems))))
+	mux.HandleFunc("DELETE /v1/cart-items/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.deleteCartItem))))
+	mux.HandleFunc("POST /v1/cart-items/checkout", app.authenticate(app.requireSession(app.requireUserActivation(app.checkoutHandler))))
+
+	mux.HandleFunc("POST /v1/balances", app.authenticate(app.requireSession(app.requireUserActivation(app.addToBalanceHandler))))
 	mux.HandleFunc("POST /v1/balances-webhook", app.balancesWebhookHandler)
 
-	mux.HandleFunc("GET /v1/orders/{id}", app.authenticate(app.requireUserActivation(app.getOrderHandler)))
-	mux.HandleFunc("GET /v1/orders", app.authenticate(app.requireUserActivation(app.getOrdersHandler)))
+	mux.HandleFunc("GET /v1/orders/{id}", app.authenticate(app.requireSession(app.requireUserActivation(app.getOrderHandler))))
+	mux.HandleFunc("GET /v1/orders", app.authenticate(app.requireSession(app.requireUserActivation(app.getOrdersHandler))))
 	mux.HandleFunc("PUT /v1/orders/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("orders:update", app.updateOrderHandler))))
 
+	mux.HandleFunc("GET /v1/admin/roles", app.authenticate(app.requireUserActivation(app.requirePermission("roles:read", app.getRolesHandler))))
+	mux.HandleFunc("POST /v1/admin/roles", app.authenticate(app.requireUserActivation(app.requirePermission("roles:create", app.createRoleHandler))))
+	mux.HandleFunc("DELETE /v1/admin/roles/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("roles:delete", app.deleteRoleHandler))))
+	mux.HandleFunc("GET /v1/admin/users/{id}/permissions", app.authenticate(app.requireUserActivation(app.requirePermission("roles:read", app.getUserPermissionsHandler))))
+	mux.HandleFunc("POST /v1/admin/users/{id}/permissions", app.authenticate(app.requireUserActivation(app.requirePermission("permissions:grant", app.grantUserPermissionsHandler))))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}/permissions/{code}", app.authenticate(app.requireUserActivation(app.requirePermission("permissions:grant", app.revokeUserPermissionHandler))))
+	mux.HandleFunc("POST /v1/admin/users/{id}/roles", app.authenticate(app.requireUserActivation(app.requirePermission("permissions:grant", app.assignUserRoleHandler))))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}/roles/{role_id}", app.authenticate(app.requireUserActivation(app.requirePermission("permissions:grant", app.revokeUserRoleHandler))))
+	mux.HandleFunc("GET /v1/admin/users", app.authenticate(app.requireUserActivation(app.requirePermission("users:read", app.getUsersHandler))))
+	mux.HandleFunc("GET /v1/admin/users/{id}", app.authenticate(app.requireUserActivation(app.requirePermission("users:read", app.getAdminUserHandler))))
+	mux.HandleFunc("PUT /v1/admin/users/{id}/suspension", app.authenticate(app.requireUserActivation(app.requirePermission("users:update", app.suspendUserHandler))))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}/suspension", app.authenticate(app.requireUserActivation(app.requirePermission("users:update", app.unsuspendUserHandler))))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}/sessions", app.authenticate(app.requireUserActivation(app.requirePermission("users:update", app.deleteUserSessionsHandler))))
+	mux.HandleFunc("DELETE /v1/admin/users/{id}/lockout", app.authenticate(app.requireUserActivation(app.requirePermission("users:update", app.unlockUserHandler))))
+
 	if app.config.limiter.enabled {
 		return app.enableCORS(app.recoverFromPanic(app.rateLimit(mux)))
 	}
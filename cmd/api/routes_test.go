@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ServeMux panics when two patterns overlap without one being more specific,
+// so composing the routes catches conflicts before the server starts.
+func TestComposeRoutes(t *testing.T) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("composing the routes panicked: %v", err)
+		}
+	}()
+	ComposeRoutes(&Application{})
+}
+
+func TestLocalImagesRoute(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "products", "1"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "products", "1", "a.jpg"), []byte("image"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		baseURL string
+		path    string
+	}{
+		{"/images", "/images/products/1/a.jpg"},
+		{"/media/", "/media/products/1/a.jpg"},
+		{"https://cdn.example.com/static/images", "/static/images/products/1/a.jpg"},
+	}
+	for _, tt := range tests {
+		app := &Application{}
+		app.config.images.backend = "local"
+		app.config.images.dir = dir
+		app.config.images.baseURL = tt.baseURL
+
+		rec := httptest.NewRecorder()
+		ComposeRoutes(app).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "image" {
+			t.Errorf("base url %q: GET %s = %d %q, want the image", tt.baseURL, tt.path, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +22,10 @@ import (
 type Storage struct {
 	queryTimeout time.Duration
 	db           *sql.DB
+	permissions  *PermissionsCache
+	// revocationTTL is how long a deleted session stays on the revocation
+	// list, it must cover the lifetime of the authentication tokens.
+	revocationTTL time.Duration
 }
 
 func NewStorage(cfg Config, queryTimeout time.Duration) (*Storage, error) {
@@ -37,10 +45,11 @@ func NewStorage(cfg Config, queryTimeout time.Duration) (*Storage, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Storage{db: db, queryTimeout: queryTimeout}, nil
+	permissions := NewPermissionsCache(cfg.cache.permissionsTTL)
+	return &Storage{db: db, queryTimeout: queryTimeout, permissions: permissions, revocationTTL: cfg.tokens.authenticationTTL}, nil
 }
 
-func (s *Storage) CreateUser(name, email string, passwordHash []byte, permissions Permissions) (*User, error) {
+func (s *Storage) CreateUser(name, email string, passwordHash []byte, roles []string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
@@ -65,13 +74,16 @@ func (s *Storage) CreateUser(name, email string, passwordHash []byte, permission
 	err = tx.QueryRowContext(ctx, query0, u.Name, u.Email, u.PasswordHash, u.IsActivated).Scan(&u.ID, &u.CreatedAt, &u.Version)
 	if err != nil {
 		tx.Rollback()
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicateEmail
+		}
 		return nil, err
 	}
 
-	query1 := `INSERT INTO users_permissions
-	           SELECT $1, p.id FROM permissions as p WHERE p.code = ANY($2)`
+	query1 := `INSERT INTO users_roles
+	           SELECT $1, r.id FROM roles as r WHERE r.name = ANY($2)`
 
-	_, err = tx.ExecContext(ctx, query1, u.ID, pq.Array(permissions))
+	_, err = tx.ExecContext(ctx, query1, u.ID, pq.Array(roles))
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -84,7 +96,7 @@ func (s *Storage) GetUserById(id int64) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT created_at, name, email, password_hash, is_activated, balance, version
+	query := `SELECT created_at, name, email, password_hash, is_activated, balance, suspended_at, version
 			  FROM users
 			  WHERE id = $1`
 
@@ -92,7 +104,7 @@ func (s *Storage) GetUserById(id int64) (*User, error) {
 	u.ID = id
 
 	args := []any{u.ID}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.Version)
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -107,15 +119,15 @@ func (s *Storage) GetUserByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT id, created_at, name, password_hash, is_activated, balance, version
+	query := `SELECT id, created_at, name, password_hash, is_activated, balance, suspended_at, version
 			  FROM users
-			  WHERE email = $1`
+			  WHERE email = $1 AND deleted_at IS NULL`
 
 	u := User{}
 	u.Email = email
 
 	args := []any{u.Email}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.Version)
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -143,246 +155,3329 @@ func (s *Storage) UpdateUser(u *User) error {
 	return nil
 }
 
-func (s *Storage) DeleteUser(u *User) error {
+func (s *Storage) GetUsers(f UserFilter) ([]User, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `DELETE FROM users
-			  WHERE id = $1`
+	op := "ASC"
+	column := f.Sort
+	if strings.HasPrefix(f.Sort, "-") {
+		column = strings.TrimPrefix(f.Sort, "-")
+		op = "DESC"
+	}
+	sortStr := fmt.Sprintf("%s %s", column, op)
+	if column != "id" {
+		sortStr = fmt.Sprintf("%s %s, id ASC", column, op)
+	}
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), id, created_at, name, email, is_activated, balance, suspended_at, version
+			              FROM users
+			              WHERE deleted_at IS NULL
+			              AND ($1 = '' OR email ILIKE '%%' || $1 || '%%')
+			              AND ($2::boolean IS NULL OR is_activated = $2)
+			              AND ($3::boolean IS NULL OR (suspended_at IS NOT NULL) = $3)
+			              AND ($4::timestamptz IS NULL OR created_at >= $4)
+			              AND ($5::timestamptz IS NULL OR created_at < $5)
+			              ORDER BY %s
+			              LIMIT $6 OFFSET $7`, sortStr)
+	limit := f.PageSize
+	offset := (f.Page - 1) * f.PageSize
 
-	args := []any{u.ID}
-	_, err := s.db.ExecContext(ctx, query, args...)
-	return err
+	email := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Email)
+	args := []any{email, f.IsActivated, f.IsSuspended, f.CreatedAfter, f.CreatedBefore, limit, offset}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	total := 0
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		err := rows.Scan(&total, &u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
 }
 
-func (s *Storage) CreateToken(userID int64, duration time.Duration, scope TokenScope) (*Token, error) {
+// SuspendUser blocks the user from signing in and ends every session.
+func (s *Storage) SuspendUser(u *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	text := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
-	hash := sha256.Sum256([]byte(text))
-	expires_at := time.Now().Add(duration)
+	query := `UPDATE users
+			  SET suspended_at = NOW(), version = version + 1
+			  WHERE id = $1 AND version = $2
+			  RETURNING suspended_at, version`
 
-	query := `INSERT INTO tokens(hash, user_id, expires_at, scope)
-			  VALUES ($1, $2, $3, $4)
-			  RETURNING id`
+	args := []any{u.ID, u.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&u.SuspendedAt, &u.Version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	t := &Token{
-		Text:      text,
-		Hash:      hash[:],
-		ExpiresAt: expires_at,
-		UserID:    userID,
-		Scope:     scope,
+	err = s.deleteAllSessions(ctx, tx, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	args := []any{hash[:], userID, expires_at, scope}
-	err = s.db.QueryRowContext(ctx, query, args...).Scan(&t.ID)
+	return tx.Commit()
+}
+
+func (s *Storage) UnsuspendUser(u *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE users
+			  SET suspended_at = NULL, version = version + 1
+			  WHERE id = $1 AND version = $2
+			  RETURNING version`
+
+	args := []any{u.ID, u.Version}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.Version)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return t, nil
+	u.SuspendedAt = nil
+	return nil
 }
 
-func (s *Storage) GetUserFromToken(text string, scope TokenScope) (*User, error) {
+// DeleteUser marks the user as deleted and signs out every session. The row is
+// kept until AnonymizeDeletedUsers runs after the grace period, so the account
+// can be restored in the meantime.
+func (s *Storage) DeleteUser(u *User) (time.Time, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.is_activated, u.balance, u.version
-			  FROM users as u
-			  INNER JOIN tokens as t
-			  on u.id = t.user_id
-			  WHERE t.hash = $1 AND t.scope = $2 AND t.expires_at > NOW()`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-	var u User
+	query0 := `UPDATE users
+			   SET deleted_at = NOW(), version = version + 1
+			   WHERE id = $1 AND version = $2
+			   RETURNING deleted_at, version`
 
-	hash := sha256.Sum256([]byte(text))
-	args := []any{hash[:], scope}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.Version)
+	deletedAt := time.Time{}
+	err = tx.QueryRowContext(ctx, query0, u.ID, u.Version).Scan(&deletedAt, &u.Version)
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+
+	query1 := `WITH f AS (
+				   DELETE FROM token_families
+				   WHERE user_id = $1
+				   RETURNING id
+			   )
+			   INSERT INTO revoked_sessions(session_id, expires_at)
+			   SELECT id, NOW() + $2 * INTERVAL '1 second' FROM f`
+
+	_, err = tx.ExecContext(ctx, query1, u.ID, int64(s.revocationTTL.Seconds()))
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+
+	query2 := `DELETE FROM tokens
+			   WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query2, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+
+	query3 := `DELETE FROM api_keys
+			   WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query3, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.permissions.Invalidate(u.ID)
+	return deletedAt, nil
+}
+
+// GetDeletedUserByEmail returns a deleted user that was not anonymized yet
+// together with the time it was deleted.
+func (s *Storage) GetDeletedUserByEmail(email string) (*User, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT id, created_at, name, password_hash, is_activated, balance, version, deleted_at
+			  FROM users
+			  WHERE email = $1 AND deleted_at IS NOT NULL AND anonymized_at IS NULL`
+
+	u := User{}
+	u.Email = email
+	deletedAt := time.Time{}
+
+	args := []any{u.Email}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.Version, &deletedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, time.Time{}, nil
 		}
-		return nil, err
+		return nil, time.Time{}, err
 	}
-	return &u, nil
+	return &u, deletedAt, nil
 }
 
-func (s *Storage) DeleteTokensForUser(userID int64, scope TokenScope) error {
+func (s *Storage) RestoreUser(u *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `DELETE FROM tokens
-			  WHERE user_id = $1 AND scope = $2`
+	query := `UPDATE users
+			  SET deleted_at = NULL, version = version + 1
+			  WHERE id = $1 AND version = $2 AND anonymized_at IS NULL
+			  RETURNING version`
 
-	args := []any{userID, scope}
-	_, err := s.db.ExecContext(ctx, query, args...)
-	return err
+	args := []any{u.ID, u.Version}
+	return s.db.QueryRowContext(ctx, query, args...).Scan(&u.Version)
 }
 
-func (s *Storage) DeleteExpiredTokens() (int, error) {
+// AnonymizeDeletedUsers scrubs the personal data of users deleted longer than
+// the grace period ago. Orders and transations still reference the row, so
+// they are kept for accounting.
+func (s *Storage) AnonymizeDeletedUsers(gracePeriod time.Duration) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `DELETE FROM tokens
-			  WHERE NOW() > expires_at`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
 
-	result, err := s.db.ExecContext(ctx, query)
+	query0 := `SELECT id, email
+			   FROM users
+			   WHERE deleted_at IS NOT NULL AND anonymized_at IS NULL AND deleted_at < NOW() - $1 * INTERVAL '1 second'
+			   FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, query0, int64(gracePeriod.Seconds()))
 	if err != nil {
+		tx.Rollback()
 		return 0, err
 	}
-	n, err := result.RowsAffected()
+
+	var ids []int64
+	var emails []string
+	for rows.Next() {
+		var id int64
+		var email string
+		err = rows.Scan(&id, &email)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		ids = append(ids, id)
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	query1 := `UPDATE users
+			   SET name = 'deleted user', email = 'deleted-user-' || id || '@invalid', password_hash = ''::bytea,
+				   is_activated = false, anonymized_at = NOW(), version = version + 1
+			   WHERE id = ANY($1)`
+
+	_, err = tx.ExecContext(ctx, query1, pq.Array(ids))
 	if err != nil {
+		tx.Rollback()
 		return 0, err
 	}
-	return int(n), nil
-}
 
-func (s *Storage) CreateProduct(name, description string, price decimal.Decimal, quantity int64) (*Product, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
-	defer cancel()
+	query2 := `DELETE FROM login_attempts
+			   WHERE email = ANY($1)`
 
-	query := `INSERT INTO products(name, description, price, quantity)
-			  VALUES ($1, $2, $3, $4)
-			  RETURNING id, created_at, updated_at, version`
+	_, err = tx.ExecContext(ctx, query2, pq.Array(emails))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
 
-	p := Product{
-		Name:        name,
-		Description: description,
-		Price:       price,
-		Quantity:    quantity,
+	tables := []string{"cart_items", "users_permissions", "users_roles", "users_totp", "recovery_codes", "email_changes", "user_identities", "api_keys", "token_families", "tokens"}
+	for _, table := range tables {
+		query := fmt.Sprintf(`DELETE FROM %s
+							  WHERE user_id = ANY($1)`, table)
+		_, err = tx.ExecContext(ctx, query, pq.Array(ids))
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
 	}
+	s.permissions.Invalidate(ids...)
+	return len(ids), nil
+}
+
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
-	args := []any{name, description, price, quantity}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt, &p.Version)
+func newToken(userID int64, duration time.Duration, scope TokenScope) (*Token, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
 		return nil, err
 	}
-	return &p, nil
+
+	text := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	hash := sha256.Sum256([]byte(text))
+
+	t := &Token{
+		Text:      text,
+		Hash:      hash[:],
+		ExpiresAt: time.Now().Add(duration),
+		UserID:    userID,
+		Scope:     scope,
+	}
+	return t, nil
 }
 
-func (s *Storage) GetProductByID(id int64) (*Product, error) {
+func insertToken(ctx context.Context, q queryRower, t *Token) error {
+	query := `INSERT INTO tokens(hash, user_id, expires_at, scope, family_id)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING id`
+
+	familyID := sql.NullInt64{Int64: t.FamilyID, Valid: t.FamilyID != 0}
+	args := []any{t.Hash, t.UserID, t.ExpiresAt, t.Scope, familyID}
+	return q.QueryRowContext(ctx, query, args...).Scan(&t.ID)
+}
+
+func (s *Storage) CreateToken(userID int64, duration time.Duration, scope TokenScope) (*Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT created_at, updated_at, name, description, price, quantity, version
-			  FROM products
-			  WHERE id = $1`
+	t, err := newToken(userID, duration, scope)
+	if err != nil {
+		return nil, err
+	}
 
-	p := Product{
-		ID: id,
+	err = insertToken(ctx, s.db, t)
+	if err != nil {
+		return nil, err
 	}
-	args := []any{id}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&p.CreatedAt, &p.UpdatedAt, &p.Name, &p.Description, &p.Price, &p.Quantity, &p.Version)
+	return t, nil
+}
+
+func createTokenPair(ctx context.Context, tx *sql.Tx, userID, familyID int64, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	access, err := newToken(userID, accessTTL, ScopeAuthentication)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+		return nil, nil, err
+	}
+	refresh, err := newToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range []*Token{access, refresh} {
+		t.FamilyID = familyID
+		err = insertToken(ctx, tx, t)
+		if err != nil {
+			return nil, nil, err
 		}
-		return nil, err
 	}
-	return &p, nil
+	return access, refresh, nil
 }
 
-func (s *Storage) GetProducts(name, description, sort string, minPrice, maxPrice decimal.Decimal, page, pageSize int) ([]Product, int, error) {
+// CreateTokenPair starts a new token family for the user and issues an
+// authentication token together with the refresh token used to renew it.
+func (s *Storage) CreateTokenPair(userID int64, userAgent, ip string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	op := "ASC"
-	column := sort
-	if strings.HasPrefix(sort, "-") {
-		column = strings.TrimPrefix(sort, "-")
-		op = "DESC"
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
 	}
-	sortStr := fmt.Sprintf("%s %s", column, op)
-	if column != "id" {
-		sortStr = fmt.Sprintf("%s %s, id ASC", column, op)
+
+	query := `INSERT INTO token_families(user_id, user_agent, ip)
+			  VALUES ($1, $2, $3)
+			  RETURNING id`
+
+	familyID := int64(0)
+	err = tx.QueryRowContext(ctx, query, userID, userAgent, ip).Scan(&familyID)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
 	}
-	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), id, created_at, updated_at, name, description, price, quantity, version
-			              FROM products
-			              WHERE ($1 = '' OR to_tsvector('simple', name) @@ plainto_tsquery('simple', $1))
-			              AND ($2 = '' OR to_tsvector('simple', description) @@ plainto_tsquery('simple', $2))
-			              AND (price BETWEEN $3 AND $4)
-			              ORDER BY %s
-			              LIMIT $5 OFFSET $6`, sortStr)
-	limit := pageSize
-	offset := (page - 1) * pageSize
 
-	args := []any{name, description, minPrice, maxPrice, limit, offset}
-	rows, err := s.db.QueryContext(ctx, query, args...)
+	access, refresh, err := createTokenPair(ctx, tx, userID, familyID, accessTTL, refreshTTL)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// RotateRefreshToken marks the refresh token as used and issues a new token pair
+// in the same family. Presenting an already rotated refresh token revokes the
+// whole family and returns ErrRefreshTokenReused. The token row is locked, so
+// a concurrent rotation of the same token waits and then sees it as rotated.
+func (s *Storage) RotateRefreshToken(text, userAgent, ip string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	query0 := `SELECT id, user_id, family_id, rotated_at
+			   FROM tokens
+			   WHERE hash = $1 AND scope = $2 AND expires_at > NOW()
+			   FOR UPDATE`
+
+	var (
+		tokenID   int64
+		userID    int64
+		familyID  sql.NullInt64
+		rotatedAt sql.NullTime
+	)
+	hash := sha256.Sum256([]byte(text))
+	err = tx.QueryRowContext(ctx, query0, hash[:], ScopeRefresh).Scan(&tokenID, &userID, &familyID, &rotatedAt)
+	if err != nil {
+		tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, 0, nil
+			return nil, nil, nil
 		}
-		return nil, 0, err
+		return nil, nil, err
+	}
+
+	if !familyID.Valid {
+		tx.Rollback()
+		return nil, nil, nil
+	}
+
+	if rotatedAt.Valid {
+		query := `WITH f AS (
+					  DELETE FROM token_families
+					  WHERE id = $1
+					  RETURNING id
+				  )
+				  INSERT INTO revoked_sessions(session_id, expires_at)
+				  SELECT id, NOW() + $2 * INTERVAL '1 second' FROM f`
+
+		_, err = tx.ExecContext(ctx, query, familyID.Int64, int64(s.revocationTTL.Seconds()))
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	query1 := `UPDATE tokens
+			   SET rotated_at = NOW()
+			   WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query1, tokenID)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	query2 := `UPDATE token_families
+			   SET last_used_at = NOW(), user_agent = $1, ip = $2
+			   WHERE id = $3`
+
+	_, err = tx.ExecContext(ctx, query2, userAgent, ip, familyID.Int64)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	access, refresh, err := createTokenPair(ctx, tx, userID, familyID.Int64, accessTTL, refreshTTL)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+func (s *Storage) GetUserFromToken(text string, scope TokenScope) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.is_activated, u.balance, u.suspended_at, u.version
+			  FROM users as u
+			  INNER JOIN tokens as t
+			  on u.id = t.user_id
+			  WHERE t.hash = $1 AND t.scope = $2 AND t.expires_at > NOW()`
+
+	var u User
+
+	hash := sha256.Sum256([]byte(text))
+	args := []any{hash[:], scope}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUserFromAuthenticationToken resolves an authentication token to its user
+// and bumps the last used time of the session the token belongs to.
+func (s *Storage) GetUserFromAuthenticationToken(text string) (*User, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `WITH t AS (
+				  SELECT id, user_id, expires_at, family_id
+				  FROM tokens
+				  WHERE hash = $1 AND scope = $2 AND expires_at > NOW()
+			  ), touched AS (
+				  UPDATE token_families
+				  SET last_used_at = NOW()
+				  WHERE id = (SELECT family_id FROM t) AND last_used_at < NOW() - INTERVAL '1 minute'
+			  )
+			  SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.is_activated, u.balance, u.suspended_at, u.version, t.id, t.expires_at, t.family_id
+			  FROM users as u
+			  INNER JOIN t
+			  ON u.id = t.user_id`
+
+	var u User
+	hash := sha256.Sum256([]byte(text))
+	t := Token{
+		Text:  text,
+		Hash:  hash[:],
+		Scope: ScopeAuthentication,
+	}
+	var familyID sql.NullInt64
+
+	args := []any{t.Hash, t.Scope}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version, &t.ID, &t.ExpiresAt, &familyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	t.UserID = u.ID
+	t.FamilyID = familyID.Int64
+	return &u, &t, nil
+}
+
+func (s *Storage) GetSessions(userID int64) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT f.id, f.created_at, f.last_used_at, f.user_agent, f.ip
+			  FROM token_families as f
+			  WHERE f.user_id = $1 AND EXISTS (
+				  SELECT 1 FROM tokens as t
+				  WHERE t.family_id = f.id AND t.expires_at > NOW() AND t.rotated_at IS NULL
+			  )
+			  ORDER BY f.last_used_at DESC, f.id DESC`
+
+	args := []any{userID}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err = rows.Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt, &session.UserAgent, &session.IP)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession revokes every token of the session and reports whether the
+// session belonged to the user.
+func (s *Storage) DeleteSession(userID, sessionID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `WITH f AS (
+				  DELETE FROM token_families
+				  WHERE id = $1 AND user_id = $2
+				  RETURNING id
+			  )
+			  INSERT INTO revoked_sessions(session_id, expires_at)
+			  SELECT id, NOW() + $3 * INTERVAL '1 second' FROM f`
+
+	args := []any{sessionID, userID, int64(s.revocationTTL.Seconds())}
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// DeleteOtherSessions revokes every session of the user except the one the
+// current token belongs to.
+func (s *Storage) DeleteOtherSessions(userID int64, current *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query0 := `WITH f AS (
+				   DELETE FROM token_families
+				   WHERE user_id = $1 AND id <> $2
+				   RETURNING id
+			   )
+			   INSERT INTO revoked_sessions(session_id, expires_at)
+			   SELECT id, NOW() + $3 * INTERVAL '1 second' FROM f`
+
+	_, err = tx.ExecContext(ctx, query0, userID, current.FamilyID, int64(s.revocationTTL.Seconds()))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query1 := `DELETE FROM tokens
+			   WHERE user_id = $1 AND family_id IS NULL AND scope = ANY($2) AND id <> $3`
+
+	scopes := []string{string(ScopeAuthentication), string(ScopeRefresh)}
+	_, err = tx.ExecContext(ctx, query1, userID, pq.Array(scopes), current.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) deleteAllSessions(ctx context.Context, tx *sql.Tx, userID int64) error {
+	query0 := `WITH f AS (
+				   DELETE FROM token_families
+				   WHERE user_id = $1
+				   RETURNING id
+			   )
+			   INSERT INTO revoked_sessions(session_id, expires_at)
+			   SELECT id, NOW() + $2 * INTERVAL '1 second' FROM f`
+
+	_, err := tx.ExecContext(ctx, query0, userID, int64(s.revocationTTL.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	query1 := `DELETE FROM tokens
+			   WHERE user_id = $1 AND scope = ANY($2)`
+
+	scopes := []string{string(ScopeAuthentication), string(ScopeRefresh), string(ScopeMFA)}
+	_, err = tx.ExecContext(ctx, query1, userID, pq.Array(scopes))
+	return err
+}
+
+// DeleteAllSessions signs the user out everywhere.
+func (s *Storage) DeleteAllSessions(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = s.deleteAllSessions(ctx, tx, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) DeleteToken(t *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM tokens
+			  WHERE id = $1`
+
+	args := []any{t.ID}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *Storage) DeleteTokensForUser(userID int64, scope TokenScope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM tokens
+			  WHERE user_id = $1 AND scope = $2`
+
+	args := []any{userID, scope}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *Storage) DeleteExpiredTokens() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM tokens
+			  WHERE NOW() > expires_at`
+
+	result, err := s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	query = `DELETE FROM token_families as f
+			 WHERE NOT EXISTS (SELECT 1 FROM tokens as t WHERE t.family_id = f.id)`
+
+	_, err = s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	query = `DELETE FROM oauth_states
+			 WHERE NOW() > expires_at`
+
+	_, err = s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	query = `DELETE FROM revoked_sessions
+			 WHERE NOW() > expires_at`
+
+	_, err = s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// GetRevokedSessions returns the sessions deleted while authentication tokens
+// issued for them may still be valid, keyed by session id.
+func (s *Storage) GetRevokedSessions() (map[int64]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT session_id, expires_at
+			  FROM revoked_sessions
+			  WHERE expires_at > NOW()`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	revoked := make(map[int64]time.Time)
+	for rows.Next() {
+		var id int64
+		var expiresAt time.Time
+		err = rows.Scan(&id, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		revoked[id] = expiresAt
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+const apiKeyPrefix = "sk_"
+
+func newAPIKey(userID int64, name string, permissions Permissions, expiresAt *time.Time) (*APIKey, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	text := apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	hash := sha256.Sum256([]byte(text))
+
+	k := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      text[:len(apiKeyPrefix)+8],
+		Text:        text,
+		Hash:        hash[:],
+		Permissions: permissions,
+		ExpiresAt:   expiresAt,
+	}
+	return k, nil
+}
+
+func (s *Storage) CreateAPIKey(userID int64, name string, permissions Permissions, expiresAt *time.Time) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	k, err := newAPIKey(userID, name, permissions, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	query0 := `INSERT INTO api_keys(user_id, name, prefix, hash, expires_at)
+			   VALUES ($1, $2, $3, $4, $5)
+			   RETURNING id, created_at`
+
+	args := []any{k.UserID, k.Name, k.Prefix, k.Hash, k.ExpiresAt}
+	err = tx.QueryRowContext(ctx, query0, args...).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	query1 := `INSERT INTO api_keys_permissions
+			   SELECT $1, p.id FROM permissions as p WHERE p.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query1, k.ID, pq.Array(k.Permissions))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *Storage) GetAPIKeys(userID int64) ([]APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT k.id, k.name, k.prefix, k.created_at, k.last_used_at, k.expires_at,
+				     COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+			  FROM api_keys as k
+			  LEFT JOIN api_keys_permissions as kp ON k.id = kp.api_key_id
+			  LEFT JOIN permissions as p ON p.id = kp.permission_id
+			  WHERE k.user_id = $1
+			  GROUP BY k.id
+			  ORDER BY k.id`
+
+	args := []any{userID}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k := APIKey{
+			UserID: userID,
+		}
+		err = rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, pq.Array((*[]string)(&k.Permissions)))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes the key and reports whether the user owned such a key.
+func (s *Storage) DeleteAPIKey(userID, keyID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM api_keys
+			  WHERE id = $1 AND user_id = $2`
+
+	args := []any{keyID, userID}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// GetUserFromAPIKey resolves an API key to its owner and bumps the last used
+// time of the key.
+func (s *Storage) GetUserFromAPIKey(text string) (*User, *APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `WITH k AS (
+				  SELECT id, user_id, name, prefix, created_at, last_used_at, expires_at
+				  FROM api_keys
+				  WHERE hash = $1 AND (expires_at IS NULL OR expires_at > NOW())
+			  ), touched AS (
+				  UPDATE api_keys
+				  SET last_used_at = NOW()
+				  WHERE id = (SELECT id FROM k) AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+			  )
+			  SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.is_activated, u.balance, u.suspended_at, u.version,
+			         k.id, k.name, k.prefix, k.created_at, k.last_used_at, k.expires_at,
+			         ARRAY(SELECT p.code FROM permissions as p
+			               INNER JOIN api_keys_permissions as kp ON p.id = kp.permission_id
+			               WHERE kp.api_key_id = k.id)
+			  FROM users as u
+			  INNER JOIN k
+			  ON u.id = k.user_id
+			  WHERE u.deleted_at IS NULL`
+
+	var u User
+	hash := sha256.Sum256([]byte(text))
+	k := APIKey{
+		Text: text,
+		Hash: hash[:],
+	}
+
+	args := []any{k.Hash}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version,
+		&k.ID, &k.Name, &k.Prefix, &k.CreatedAt, &k.LastUsedAt, &k.ExpiresAt, pq.Array((*[]string)(&k.Permissions)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	k.UserID = u.ID
+	return &u, &k, nil
+}
+
+var ErrDuplicateEmail = errors.New("a user with this email address already exists")
+
+// CreateEmailChange stages a change of the user's email, replacing any change
+// that was not confirmed yet.
+func (s *Storage) CreateEmailChange(u *User, newEmail string) (*EmailChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	query0 := `DELETE FROM email_changes
+			   WHERE user_id = $1 AND confirmed_at IS NULL`
+
+	_, err = tx.ExecContext(ctx, query0, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	query1 := `INSERT INTO email_changes(user_id, old_email, new_email)
+			   VALUES ($1, $2, $3)
+			   RETURNING id, created_at`
+
+	c := EmailChange{
+		UserID:   u.ID,
+		OldEmail: u.Email,
+		NewEmail: newEmail,
+	}
+	err = tx.QueryRowContext(ctx, query1, c.UserID, c.OldEmail, c.NewEmail).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Storage) getEmailChange(query string, userID int64) (*EmailChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	c := EmailChange{
+		UserID: userID,
+	}
+	var confirmedAt sql.NullTime
+	args := []any{userID}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&c.ID, &c.CreatedAt, &c.OldEmail, &c.NewEmail, &confirmedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	c.ConfirmedAt = confirmedAt.Time
+	return &c, nil
+}
+
+func (s *Storage) GetPendingEmailChange(userID int64) (*EmailChange, error) {
+	query := `SELECT id, created_at, old_email, new_email, confirmed_at
+			  FROM email_changes
+			  WHERE user_id = $1 AND confirmed_at IS NULL
+			  ORDER BY id DESC
+			  LIMIT 1`
+	return s.getEmailChange(query, userID)
+}
+
+func (s *Storage) GetLastConfirmedEmailChange(userID int64) (*EmailChange, error) {
+	query := `SELECT id, created_at, old_email, new_email, confirmed_at
+			  FROM email_changes
+			  WHERE user_id = $1 AND confirmed_at IS NOT NULL AND reverted_at IS NULL
+			  ORDER BY confirmed_at DESC, id DESC
+			  LIMIT 1`
+	return s.getEmailChange(query, userID)
+}
+
+func (s *Storage) setUserEmail(ctx context.Context, tx *sql.Tx, u *User, email string) error {
+	query := `UPDATE users
+			  SET email = $1, version = version + 1
+			  WHERE id = $2 AND version = $3
+			  RETURNING version`
+
+	err := tx.QueryRowContext(ctx, query, email, u.ID, u.Version).Scan(&u.Version)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateEmail
+		}
+		return err
+	}
+	u.Email = email
+	return nil
+}
+
+func (s *Storage) ConfirmEmailChange(u *User, c *EmailChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = s.setUserEmail(ctx, tx, u, c.NewEmail)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `UPDATE email_changes
+			  SET confirmed_at = NOW()
+			  WHERE id = $1
+			  RETURNING confirmed_at`
+
+	err = tx.QueryRowContext(ctx, query, c.ID).Scan(&c.ConfirmedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) RevertEmailChange(u *User, c *EmailChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = s.setUserEmail(ctx, tx, u, c.OldEmail)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `UPDATE email_changes
+			  SET reverted_at = NOW()
+			  WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, c.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) CreateOAuthState(st *OAuthState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO oauth_states(state, provider, code_verifier, nonce, expires_at)
+			  VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{st.State, st.Provider, st.CodeVerifier, st.Nonce, st.ExpiresAt}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ConsumeOAuthState deletes and returns the state so every authorization
+// request can only be completed once.
+func (s *Storage) ConsumeOAuthState(state, provider string) (*OAuthState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM oauth_states
+			  WHERE state = $1 AND provider = $2 AND expires_at > NOW()
+			  RETURNING code_verifier, nonce, expires_at`
+
+	st := OAuthState{
+		State:    state,
+		Provider: provider,
+	}
+	args := []any{state, provider}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&st.CodeVerifier, &st.Nonce, &st.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *Storage) GetUserByIdentity(provider, subject string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.is_activated, u.balance, u.suspended_at, u.version
+			  FROM users as u
+			  INNER JOIN user_identities as i
+			  ON u.id = i.user_id
+			  WHERE i.provider = $1 AND i.subject = $2 AND u.deleted_at IS NULL`
+
+	var u User
+	args := []any{provider, subject}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Balance, &u.SuspendedAt, &u.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func insertIdentity(ctx context.Context, tx *sql.Tx, userID int64, identity *ExternalIdentity) error {
+	query := `INSERT INTO user_identities(user_id, provider, subject, email)
+			  VALUES ($1, $2, $3, $4)`
+
+	args := []any{userID, identity.Provider, identity.Subject, identity.Email}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// LinkIdentity attaches the external identity to an existing user whose email
+// the provider verified, activating the user if needed.
+func (s *Storage) LinkIdentity(u *User, identity *ExternalIdentity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = insertIdentity(ctx, tx, u.ID, identity)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !u.IsActivated {
+		query := `UPDATE users
+				  SET is_activated = true, version = version + 1
+				  WHERE id = $1 AND version = $2
+				  RETURNING version`
+
+		err = tx.QueryRowContext(ctx, query, u.ID, u.Version).Scan(&u.Version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		u.IsActivated = true
+	}
+
+	return tx.Commit()
+}
+
+// CreateUserWithIdentity signs up an activated user from an external identity.
+// The user has no usable password until one is set through a password reset.
+func (s *Storage) CreateUserWithIdentity(name string, identity *ExternalIdentity, roles []string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	query0 := `INSERT INTO users(name, email, password_hash, is_activated)
+	           VALUES ($1, $2, $3, true)
+			   RETURNING id, created_at, version`
+
+	u := User{
+		Name:         name,
+		Email:        identity.Email,
+		PasswordHash: []byte{},
+		IsActivated:  true,
+	}
+	err = tx.QueryRowContext(ctx, query0, u.Name, u.Email, u.PasswordHash).Scan(&u.ID, &u.CreatedAt, &u.Version)
+	if err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicateEmail
+		}
+		return nil, err
+	}
+
+	query1 := `INSERT INTO users_roles
+	           SELECT $1, r.id FROM roles as r WHERE r.name = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query1, u.ID, pq.Array(roles))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = insertIdentity(ctx, tx, u.ID, identity)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Storage) GetTOTP(userID int64) (*TOTP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT created_at, secret, is_enabled, last_used_step
+			  FROM users_totp
+			  WHERE user_id = $1`
+
+	t := TOTP{
+		UserID: userID,
+	}
+	args := []any{userID}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&t.CreatedAt, &t.Secret, &t.IsEnabled, &t.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetTOTPSecret starts (or restarts) a TOTP enrollment. It never touches a
+// secret that was already enabled.
+func (s *Storage) SetTOTPSecret(userID int64, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO users_totp(user_id, secret)
+			  VALUES ($1, $2)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+			  WHERE users_totp.is_enabled = false`
+
+	args := []any{userID, secret}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *Storage) EnableTOTP(userID int64, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query0 := `UPDATE users_totp
+			   SET is_enabled = true, last_used_step = $1
+			   WHERE user_id = $2 AND is_enabled = false`
+
+	_, err = tx.ExecContext(ctx, query0, step, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query1 := `DELETE FROM recovery_codes
+			   WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query1, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query2 := `INSERT INTO recovery_codes(user_id, hash)
+			   SELECT $1, unnest($2::bytea[])`
+
+	_, err = tx.ExecContext(ctx, query2, userID, pq.ByteaArray(recoveryHashes))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the step of an accepted code and reports false if that
+// step (or a later one) was already used, preventing code replays.
+func (s *Storage) UseTOTPStep(userID int64, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE users_totp
+			  SET last_used_step = $1
+			  WHERE user_id = $2 AND last_used_step < $1`
+
+	args := []any{step, userID}
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+func (s *Storage) UseRecoveryCode(userID int64, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE recovery_codes
+			  SET used_at = NOW()
+			  WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	args := []any{userID, hashRecoveryCode(code)}
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+func (s *Storage) DeleteTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query0 := `DELETE FROM users_totp
+			   WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query0, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query1 := `DELETE FROM recovery_codes
+			   WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query1, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) GetLoginAttempt(email string) (*LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT email, failures, last_failed_at, locked_until
+			  FROM login_attempts
+			  WHERE email = $1`
+
+	a := LoginAttempt{}
+	var lockedUntil sql.NullTime
+	args := []any{email}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&a.Email, &a.Failures, &a.LastFailedAt, &lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	a.LockedUntil = lockedUntil.Time
+	return &a, nil
+}
+
+// RecordFailedLogin counts a failed login for the email and locks it once the
+// failures reach maxFailures. The failure counter restarts after a lockout.
+func (s *Storage) RecordFailedLogin(email string, maxFailures int, lockout time.Duration) (*LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO login_attempts(email, failures, last_failed_at)
+			  VALUES ($1, 1, NOW())
+			  ON CONFLICT (email) DO UPDATE
+			  SET failures = CASE WHEN login_attempts.failures + 1 >= $2 THEN 0 ELSE login_attempts.failures + 1 END,
+				  locked_until = CASE WHEN login_attempts.failures + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second' ELSE login_attempts.locked_until END,
+				  last_failed_at = NOW()
+			  RETURNING email, failures, last_failed_at, locked_until`
+
+	a := LoginAttempt{}
+	var lockedUntil sql.NullTime
+	args := []any{email, maxFailures, int64(lockout.Seconds())}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&a.Email, &a.Failures, &a.LastFailedAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	a.LockedUntil = lockedUntil.Time
+	return &a, nil
+}
+
+func (s *Storage) ClearLoginAttempts(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM login_attempts
+			  WHERE email = $1`
+
+	args := []any{email}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+var ErrUnknownCategory = errors.New("category does not exist")
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// setProductCategories replaces the categories of the product.
+func setProductCategories(ctx context.Context, tx *sql.Tx, productID int64, categoryIDs []int64) error {
+	query0 := `DELETE FROM products_categories
+			   WHERE product_id = $1 AND category_id <> ALL($2)`
+
+	_, err := tx.ExecContext(ctx, query0, productID, pq.Array(categoryIDs))
+	if err != nil {
+		return err
+	}
+
+	query1 := `INSERT INTO products_categories(product_id, category_id)
+			   SELECT $1, unnest($2::bigint[])
+			   ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query1, productID, pq.Array(categoryIDs))
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrUnknownCategory
+		}
+		return err
+	}
+	return nil
+}
+
+// ErrDuplicateProductSKU is returned when another product has the same SKU.
+var ErrDuplicateProductSKU = errors.New("a product with this sku already exists")
+
+func productUniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "products_sku_index" {
+		return ErrDuplicateProductSKU
+	}
+	return err
+}
+
+// recordProductChange adds the difference between the two versions of the
+// product to its history, userID is zero for changes made by the system. An
+// update that changed none of the recorded fields is not recorded.
+func recordProductChange(ctx context.Context, tx *sql.Tx, userID int64, action ProductChangeAction, before, after *Product) error {
+	changes, err := diffProducts(before, after)
+	if err != nil {
+		return err
+	}
+	if action == ProductUpdated && len(changes) == 0 {
+		return nil
+	}
+	return insertProductChange(ctx, tx, cmp.Or(after, before).ID, userID, action, changes)
+}
+
+// recordProductFieldChanges adds the fields of the variants, attributes or
+// images of the product that differ between before and after to its history
+// as an update, nothing is recorded when none does.
+func recordProductFieldChanges(ctx context.Context, tx *sql.Tx, productID, userID int64, before, after map[string]any) error {
+	changes, err := diffFields(before, after)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return insertProductChange(ctx, tx, productID, userID, ProductUpdated, changes)
+}
+
+func insertProductChange(ctx context.Context, tx *sql.Tx, productID, userID int64, action ProductChangeAction, changes map[string]FieldChange) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO product_changes(product_id, user_id, action, changes)
+			  VALUES ($1, NULLIF($2::bigint, 0), $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, productID, userID, action, data)
+	return err
+}
+
+// lockProduct locks the product until the end of the transaction, so that
+// the changes of its variants, attributes and images are recorded in order.
+func lockProduct(ctx context.Context, tx *sql.Tx, id int64) error {
+	query := `SELECT id
+			  FROM products
+			  WHERE id = $1
+			  FOR UPDATE`
+
+	return tx.QueryRowContext(ctx, query, id).Scan(&id)
+}
+
+// getProductForUpdate reads the fields of the product recorded in its history
+// and locks it until the end of the transaction.
+func getProductForUpdate(ctx context.Context, tx *sql.Tx, id int64) (*Product, error) {
+	query := `SELECT COALESCE(sku, ''), name, description, price, quantity, options, status, publish_at, unpublish_at,
+			         ARRAY(SELECT category_id FROM products_categories WHERE product_id = products.id ORDER BY category_id)
+			  FROM products
+			  WHERE id = $1
+			  FOR UPDATE`
+
+	p := Product{
+		ID: id,
+	}
+	err := tx.QueryRowContext(ctx, query, id).Scan(&p.SKU, &p.Name, &p.Description, &p.Price, &p.Quantity, pq.Array(&p.Options),
+		&p.Status, &p.PublishAt, &p.UnpublishAt, pq.Array(&p.CategoryIDs))
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CreateProduct saves the product and records its creation by the user.
+func (s *Storage) CreateProduct(p *Product, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO products(name, description, price, quantity, options, status, publish_at, unpublish_at, sku)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''))
+			  RETURNING id, created_at, updated_at, version`
+
+	if p.CategoryIDs == nil {
+		p.CategoryIDs = []int64{}
+	}
+	if p.Options == nil {
+		p.Options = []string{}
+	}
+	if p.Status == "" {
+		p.Status = ProductDraft
+	}
+	p.Images = []ProductImage{}
+	p.Attributes = map[string]any{}
+
+	args := []any{p.Name, p.Description, p.Price, p.Quantity, pq.Array(p.Options), p.Status, p.PublishAt, p.UnpublishAt, p.SKU}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt, &p.Version)
+	if err != nil {
+		tx.Rollback()
+		return productUniqueViolation(err)
+	}
+
+	err = setProductCategories(ctx, tx, p.ID, p.CategoryIDs)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = recordProductChange(ctx, tx, userID, ProductCreated, nil, p)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) GetProductByID(id int64) (*Product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT created_at, updated_at, COALESCE(sku, ''), name, description, price, quantity, options, status, publish_at, unpublish_at, version,
+			         ARRAY(SELECT category_id FROM products_categories WHERE product_id = products.id ORDER BY category_id)
+			  FROM products
+			  WHERE id = $1`
+
+	p := Product{
+		ID: id,
+	}
+	args := []any{id}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&p.CreatedAt, &p.UpdatedAt, &p.SKU, &p.Name, &p.Description, &p.Price, &p.Quantity, pq.Array(&p.Options),
+		&p.Status, &p.PublishAt, &p.UnpublishAt, &p.Version, pq.Array(&p.CategoryIDs))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	p.Variants, err = s.GetProductVariants(p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.GetProductsImages(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	p.Images = images[p.ID]
+
+	attributes, err := s.GetProductsAttributes(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	p.Attributes = attributes[p.ID]
+	return &p, nil
+}
+
+// GetProductBySKU returns the product with the SKU, or nil when there is
+// none.
+func (s *Storage) GetProductBySKU(sku string) (*Product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT id
+			  FROM products
+			  WHERE sku = $1`
+
+	var id int64
+	err := s.db.QueryRowContext(ctx, query, sku).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s.GetProductByID(id)
+}
+
+// whereBuilder collects the conditions of a dynamic WHERE clause together
+// with their arguments.
+type whereBuilder struct {
+	conds []string
+	args  []any
+}
+
+// arg adds an argument and returns its placeholder.
+func (b *whereBuilder) arg(v any) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *whereBuilder) add(cond string) {
+	b.conds = append(b.conds, cond)
+}
+
+func (b *whereBuilder) String() string {
+	if len(b.conds) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(b.conds, " AND ")
+}
+
+// searchConfig is the text search configuration of products.search_vector,
+// queries must use the same one for the stemmed words to match.
+const searchConfig = "english"
+
+func searchQuery(placeholder string) string {
+	return fmt.Sprintf("websearch_to_tsquery('%s', %s)", searchConfig, placeholder)
+}
+
+// htmlEscape escapes the text of a column before ts_headline wraps the matches
+// in <mark> tags, so the highlights are safe to render as HTML. The ampersand
+// is replaced first to keep the other entities intact.
+func htmlEscape(column string) string {
+	return fmt.Sprintf(`replace(replace(replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`, column)
+}
+
+// productInStock tells whether a row of products can be bought, products with
+// variants are in stock when one of their variants is.
+const productInStock = `CASE
+	WHEN EXISTS (SELECT 1 FROM product_variants as v WHERE v.product_id = products.id)
+	THEN EXISTS (SELECT 1 FROM product_variants as v WHERE v.product_id = products.id AND v.quantity > 0)
+	ELSE products.quantity > 0
+END`
+
+func (f *ProductFilter) where() *whereBuilder {
+	b := &whereBuilder{}
+	if f.Query != "" {
+		b.add(fmt.Sprintf("search_vector @@ %s", searchQuery(b.arg(f.Query))))
+	}
+	if f.Name != "" {
+		b.add(fmt.Sprintf("to_tsvector('simple', name) @@ plainto_tsquery('simple', %s)", b.arg(f.Name)))
+	}
+	if f.Description != "" {
+		b.add(fmt.Sprintf("to_tsvector('simple', description) @@ plainto_tsquery('simple', %s)", b.arg(f.Description)))
+	}
+	b.add(fmt.Sprintf("price BETWEEN %s AND %s", b.arg(f.MinPrice), b.arg(f.MaxPrice)))
+	if f.CategoryID != 0 {
+		b.add(fmt.Sprintf(`id IN (
+			SELECT pc.product_id
+			FROM products_categories as pc
+			WHERE pc.category_id IN (
+				WITH RECURSIVE tree AS (
+					SELECT id FROM categories WHERE id = %s
+					UNION
+					SELECT c.id FROM categories as c INNER JOIN tree ON c.parent_id = tree.id
+				)
+				SELECT id FROM tree
+			)
+		)`, b.arg(f.CategoryID)))
+	}
+	if f.InStock != nil {
+		b.add(fmt.Sprintf("(%s) = %s", productInStock, b.arg(*f.InStock)))
+	}
+	if f.Status != "" {
+		b.add(fmt.Sprintf("status = %s", b.arg(f.Status)))
+	}
+	for _, af := range f.Attributes {
+		conds := []string{fmt.Sprintf("pa.attribute_id = %s", b.arg(af.Attribute.ID))}
+		if af.Equals != nil {
+			switch {
+			case af.Equals.Text != nil:
+				conds = append(conds, fmt.Sprintf("pa.value_text = %s", b.arg(*af.Equals.Text)))
+			case af.Equals.Number != nil:
+				conds = append(conds, fmt.Sprintf("pa.value_number = %s", b.arg(*af.Equals.Number)))
+			case af.Equals.Boolean != nil:
+				conds = append(conds, fmt.Sprintf("pa.value_boolean = %s", b.arg(*af.Equals.Boolean)))
+			}
+		}
+		if af.Min != nil {
+			conds = append(conds, fmt.Sprintf("pa.value_number >= %s", b.arg(*af.Min)))
+		}
+		if af.Max != nil {
+			conds = append(conds, fmt.Sprintf("pa.value_number <= %s", b.arg(*af.Max)))
+		}
+		b.add(fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM product_attributes as pa
+			WHERE pa.product_id = products.id AND %s
+		)`, strings.Join(conds, " AND ")))
+	}
+	return b
+}
+
+// productSortKeys maps the sort options of the product listing to their
+// column and type, relevance is replaced by the rank of the search query.
+var productSortKeys = map[string]keyset{
+	"id":         {column: "id", typ: "bigint"},
+	"name":       {column: "name", typ: "text"},
+	"created_at": {column: "created_at", typ: "timestamptz"},
+	"price":      {column: "price", typ: "numeric"},
+	"relevance":  {typ: "real", desc: true},
+}
+
+// GetProducts returns a page of the products matching the filter. The page is
+// read by offset when f.Page is set, which also counts the matching products,
+// and after f.Cursor otherwise.
+func (s *Storage) GetProducts(f ProductFilter) ([]Product, Pagination, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	column := strings.TrimPrefix(f.Sort, "-")
+	k := productSortKeys[column]
+	k.desc = k.desc || strings.HasPrefix(f.Sort, "-")
+	where := f.where()
+
+	// without a search query there is nothing to rank or highlight
+	rank := "0"
+	highlights := "NULL, NULL"
+	if f.Query != "" {
+		tsquery := searchQuery(where.arg(f.Query))
+		rank = fmt.Sprintf("ts_rank(search_vector, %s)", tsquery)
+		highlights = fmt.Sprintf(`ts_headline('%[1]s', %[3]s, %[2]s, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+			ts_headline('%[1]s', %[4]s, %[2]s, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5')`,
+			searchConfig, tsquery, htmlEscape("name"), htmlEscape("description"))
+	}
+	if column == "relevance" {
+		k.column = rank
+	}
+
+	var sortStr, total, page string
+	if f.Page > 0 {
+		// offset pages keep the id as an ascending tie breaker
+		dir := "ASC"
+		if k.desc {
+			dir = "DESC"
+		}
+		sortStr = fmt.Sprintf("%s %s", k.column, dir)
+		if k.column != "id" {
+			sortStr = fmt.Sprintf("%s %s, id ASC", k.column, dir)
+		}
+		total = "COUNT(*) OVER()"
+		page = fmt.Sprintf("LIMIT %s OFFSET %s", where.arg(f.PageSize), where.arg((f.Page-1)*f.PageSize))
+	} else {
+		sortStr = k.apply(where, f.Cursor, "id")
+		total = "0"
+		page = fmt.Sprintf("LIMIT %s", where.arg(f.PageSize+1))
+	}
+	query := fmt.Sprintf(`SELECT %s, id, created_at, updated_at, COALESCE(sku, ''), name, description, price, quantity, options, status, publish_at, unpublish_at, version,
+			                     ARRAY(SELECT category_id FROM products_categories WHERE product_id = products.id ORDER BY category_id),
+			                     %s, %s, (%s)::text
+			              FROM products
+			              WHERE %s
+			              ORDER BY %s
+			              %s`, total, rank, highlights, k.column, where, sortStr, page)
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	count := 0
+	keyed := []keyedRow[Product]{}
+	for rows.Next() {
+		p := Product{}
+		var rank float64
+		var nameHighlight, descriptionHighlight sql.NullString
+		var key string
+		err := rows.Scan(&count, &p.ID, &p.CreatedAt, &p.UpdatedAt, &p.SKU, &p.Name, &p.Description, &p.Price, &p.Quantity, pq.Array(&p.Options),
+			&p.Status, &p.PublishAt, &p.UnpublishAt, &p.Version, pq.Array(&p.CategoryIDs),
+			&rank, &nameHighlight, &descriptionHighlight, &key)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		if f.Query != "" {
+			p.Search = &ProductSearchResult{
+				Rank:                 rank,
+				NameHighlight:        nameHighlight.String,
+				DescriptionHighlight: descriptionHighlight.String,
+			}
+		}
+		keyed = append(keyed, keyedRow[Product]{row: p, key: key, id: p.ID})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Pagination{}, err
+	}
+
+	var products []Product
+	var pagination Pagination
+	if f.Page > 0 {
+		products = make([]Product, len(keyed))
+		for i := range keyed {
+			products[i] = keyed[i].row
+		}
+		pagination = Pagination{Page: f.Page, PageSize: f.PageSize, Total: &count}
+	} else {
+		products, pagination = paginate(keyed, f.Cursor, f.Sort, f.PageSize)
+	}
+
+	ids := make([]int64, len(products))
+	for i := range products {
+		ids[i] = products[i].ID
+	}
+	images, err := s.GetProductsImages(ids...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	attributes, err := s.GetProductsAttributes(ids...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	for i := range products {
+		products[i].Images = images[products[i].ID]
+		products[i].Attributes = attributes[products[i].ID]
+	}
+	return products, pagination, nil
+}
+
+// priceBucketEdges are the upper bounds of the price facet buckets, the last
+// bucket has no upper bound.
+var priceBucketEdges = []decimal.Decimal{
+	decimal.NewFromInt(25),
+	decimal.NewFromInt(50),
+	decimal.NewFromInt(100),
+	decimal.NewFromInt(250),
+	decimal.NewFromInt(500),
+}
+
+// GetProductFacets counts the products matching the filter by price bucket,
+// category, availability and variant option value.
+func (s *Storage) GetProductFacets(f ProductFilter) (*ProductFacets, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	where := f.where()
+	edges := where.arg(pq.Array(priceBucketEdges))
+	query := fmt.Sprintf(`WITH filtered AS (
+							  SELECT id, price, %s as in_stock
+							  FROM products
+							  WHERE %s
+						  )
+						  SELECT 'price', width_bucket(price, %s::numeric[])::text, NULL, COUNT(*)
+						  FROM filtered
+						  GROUP BY 2
+						  UNION ALL
+						  SELECT 'category', c.id::text, c.name, COUNT(*)
+						  FROM filtered
+						  INNER JOIN products_categories as pc ON pc.product_id = filtered.id
+						  INNER JOIN categories as c ON c.id = pc.category_id
+						  GROUP BY c.id, c.name
+						  UNION ALL
+						  SELECT 'availability', in_stock::text, NULL, COUNT(*)
+						  FROM filtered
+						  GROUP BY 2
+						  UNION ALL
+						  SELECT 'option', o.value, o.key, COUNT(DISTINCT filtered.id)
+						  FROM filtered
+						  INNER JOIN product_variants as v ON v.product_id = filtered.id
+						  CROSS JOIN jsonb_each_text(v.options) as o
+						  GROUP BY o.key, o.value
+						  UNION ALL
+						  SELECT 'attribute', COALESCE(pa.value_text, pa.value_boolean::text), a.code, COUNT(*)
+						  FROM filtered
+						  INNER JOIN product_attributes as pa ON pa.product_id = filtered.id
+						  INNER JOIN attributes as a ON a.id = pa.attribute_id
+						  WHERE a.type IN ('string', 'enum', 'boolean')
+						  GROUP BY a.code, 2`, productInStock, where, edges)
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	facets := &ProductFacets{
+		Price:      make([]PriceFacet, len(priceBucketEdges)+1),
+		Categories: []CategoryFacet{},
+		Options:    map[string][]FacetValue{},
+		Attributes: map[string][]FacetValue{},
+	}
+	for i := range facets.Price {
+		if i > 0 {
+			facets.Price[i].Min = &priceBucketEdges[i-1]
+		}
+		if i < len(priceBucketEdges) {
+			facets.Price[i].Max = &priceBucketEdges[i]
+		}
+	}
+
+	for rows.Next() {
+		var facet, value string
+		var label sql.NullString
+		var count int
+		err := rows.Scan(&facet, &value, &label, &count)
+		if err != nil {
+			return nil, err
+		}
+		switch facet {
+		case "price":
+			bucket, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			facets.Price[bucket].Count = count
+		case "category":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			facets.Categories = append(facets.Categories, CategoryFacet{ID: id, Name: label.String, Count: count})
+		case "availability":
+			if value == "true" {
+				facets.Availability.InStock = count
+			} else {
+				facets.Availability.OutOfStock = count
+			}
+		case "option":
+			facets.Options[label.String] = append(facets.Options[label.String], FacetValue{Value: value, Count: count})
+		case "attribute":
+			facets.Attributes[label.String] = append(facets.Attributes[label.String], FacetValue{Value: value, Count: count})
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(facets.Categories, func(a, b CategoryFacet) int {
+		return cmp.Or(b.Count-a.Count, cmp.Compare(a.ID, b.ID))
+	})
+	for _, facet := range []map[string][]FacetValue{facets.Options, facets.Attributes} {
+		for _, values := range facet {
+			slices.SortFunc(values, func(a, b FacetValue) int {
+				return cmp.Or(b.Count-a.Count, strings.Compare(a.Value, b.Value))
+			})
+		}
+	}
+	return facets, nil
+}
+
+// prefixQuery builds a tsquery matching the words where the last one may be
+// incomplete, e.g. "red sh" becomes "red & sh:*". The words must only contain
+// letters and digits.
+func prefixQuery(words []string) string {
+	return strings.Join(words, " & ") + ":*"
+}
+
+// GetProductCompletions returns products whose name contains the words, the
+// last one as a prefix. Names starting with the words come first. Only
+// products in the status are returned unless it is empty.
+func (s *Storage) GetProductCompletions(words []string, status ProductStatus, limit int) ([]ProductSuggestion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT id, name, 0
+			  FROM products
+			  WHERE to_tsvector('simple', name) @@ to_tsquery('simple', $1) AND ($4::text = '' OR status = $4)
+			  ORDER BY lower(name) LIKE $2 DESC, length(name), id
+			  LIMIT $3`
+
+	args := []any{prefixQuery(words), strings.Join(words, " ") + "%", limit, status}
+	return s.getProductSuggestions(ctx, query, args...)
+}
+
+// GetFuzzyProductMatches returns products whose name is similar to the text or
+// contains a word similar to it, using the pg_trgm default thresholds. Only
+// products in the status are returned unless it is empty.
+func (s *Storage) GetFuzzyProductMatches(text string, status ProductStatus, limit int) ([]ProductSuggestion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT id, name, word_similarity(lower($1), lower(name)) as similarity
+			  FROM products
+			  WHERE (lower(name) % lower($1) OR lower($1) <% lower(name)) AND ($3::text = '' OR status = $3)
+			  ORDER BY similarity DESC, id
+			  LIMIT $2`
+
+	return s.getProductSuggestions(ctx, query, text, limit, status)
+}
+
+func (s *Storage) getProductSuggestions(ctx context.Context, query string, args ...any) ([]ProductSuggestion, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	suggestions := []ProductSuggestion{}
+	for rows.Next() {
+		ps := ProductSuggestion{}
+		err := rows.Scan(&ps.ID, &ps.Name, &ps.Similarity)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, ps)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// GetDidYouMean replaces every word by the most similar word of the catalog
+// and returns the corrected text, or an empty string when nothing changed.
+func (s *Storage) GetDidYouMean(words []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT word
+			  FROM product_words
+			  WHERE word % $1
+			  ORDER BY similarity(word, $1) DESC, ndoc DESC, word
+			  LIMIT 1`
+
+	corrected := make([]string, len(words))
+	changed := false
+	for i, word := range words {
+		corrected[i] = word
+		err := s.db.QueryRowContext(ctx, query, word).Scan(&corrected[i])
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		changed = changed || corrected[i] != word
+	}
+	if !changed {
+		return "", nil
+	}
+	return strings.Join(corrected, " "), nil
+}
+
+// ApplyProductSchedules publishes the drafts whose publish_at has passed and
+// archives the published products whose unpublish_at has, clearing the
+// timestamps that were applied. The changes are recorded in the history of
+// the products without a user.
+func (s *Storage) ApplyProductSchedules() (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query0 := `WITH changed AS (
+			       UPDATE products as p
+			       SET status = 'published', publish_at = NULL, updated_at = NOW(), version = p.version + 1
+			       FROM (SELECT id, publish_at FROM products WHERE status = 'draft' AND publish_at <= NOW() FOR UPDATE) as old
+			       WHERE p.id = old.id
+			       RETURNING p.id, old.publish_at
+			   )
+			   INSERT INTO product_changes(product_id, action, changes)
+			   SELECT id, 'update', jsonb_build_object(
+			       'status', jsonb_build_object('before', 'draft'::text, 'after', 'published'::text),
+			       'publish_at', jsonb_build_object('before', publish_at, 'after', NULL)
+			   )
+			   FROM changed`
+
+	query1 := `WITH changed AS (
+			       UPDATE products as p
+			       SET status = 'archived', unpublish_at = NULL, updated_at = NOW(), version = p.version + 1
+			       FROM (SELECT id, unpublish_at FROM products WHERE status = 'published' AND unpublish_at <= NOW() FOR UPDATE) as old
+			       WHERE p.id = old.id
+			       RETURNING p.id, old.unpublish_at
+			   )
+			   INSERT INTO product_changes(product_id, action, changes)
+			   SELECT id, 'update', jsonb_build_object(
+			       'status', jsonb_build_object('before', 'published'::text, 'after', 'archived'::text),
+			       'unpublish_at', jsonb_build_object('before', unpublish_at, 'after', NULL)
+			   )
+			   FROM changed`
+
+	result, err := s.db.ExecContext(ctx, query0)
+	if err != nil {
+		return 0, 0, err
+	}
+	published, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err = s.db.ExecContext(ctx, query1)
+	if err != nil {
+		return published, 0, err
+	}
+	archived, err := result.RowsAffected()
+	if err != nil {
+		return published, 0, err
+	}
+	return published, archived, nil
+}
+
+// RefreshProductWords rebuilds the words GetDidYouMean picks corrections
+// from.
+func (s *Storage) RefreshProductWords() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY product_words`)
+	return err
+}
+
+// UpdateProduct saves the product and records the changes made by the user.
+func (s *Storage) UpdateProduct(p *Product, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	before, err := getProductForUpdate(ctx, tx, p.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `UPDATE products
+	          SET name = $1, description = $2, price = $3, quantity = $4, options = $5, status = $6, publish_at = $7, unpublish_at = $8,
+			      sku = NULLIF($9, ''), updated_at = NOW(), version = version + 1
+			  WHERE id = $10 AND version = $11
+			  RETURNING version`
+
+	args := []any{p.Name, p.Description, p.Price, p.Quantity, pq.Array(p.Options), p.Status, p.PublishAt, p.UnpublishAt, p.SKU, p.ID, p.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&p.Version)
+	if err != nil {
+		tx.Rollback()
+		return productUniqueViolation(err)
+	}
+
+	err = setProductCategories(ctx, tx, p.ID, p.CategoryIDs)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = recordProductChange(ctx, tx, userID, ProductUpdated, before, p)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteProduct deletes the product and records its last state as deleted by
+// the user.
+func (s *Storage) DeleteProduct(p *Product, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	before, err := getProductForUpdate(ctx, tx, p.ID)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	query := `DELETE FROM products
+			  WHERE id = $1`
+
+	args := []any{p.ID}
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = recordProductChange(ctx, tx, userID, ProductDeleted, before, nil)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetProductChanges returns a page of the history of the product, it is kept
+// after the product is deleted.
+func (s *Storage) GetProductChanges(productID int64, sort string, c *Cursor, pageSize int) ([]ProductChange, Pagination, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	k := keyset{column: "id", typ: "bigint", desc: sort == "-id"}
+	where := &whereBuilder{}
+	where.add(fmt.Sprintf("product_id = %s", where.arg(productID)))
+	order := k.apply(where, c, "id")
+	query := fmt.Sprintf(`SELECT id, created_at, product_id, user_id, action, changes
+			              FROM product_changes
+			              WHERE %s
+			              ORDER BY %s
+			              LIMIT %s`, where, order, where.arg(pageSize+1))
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keyed := []keyedRow[ProductChange]{}
+	for rows.Next() {
+		pc := ProductChange{}
+		var userID sql.NullInt64
+		var changes []byte
+		err := rows.Scan(&pc.ID, &pc.CreatedAt, &pc.ProductID, &userID, &pc.Action, &changes)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		if userID.Valid {
+			pc.UserID = &userID.Int64
+		}
+		err = json.Unmarshal(changes, &pc.Changes)
+		if err != nil {
+			return nil, Pagination{}, err
+		}
+		keyed = append(keyed, keyedRow[ProductChange]{row: pc, id: pc.ID})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Pagination{}, err
+	}
+
+	page, pagination := paginate(keyed, c, sort, pageSize)
+	return page, pagination, nil
+}
+
+// ExportProducts calls fn with every product in id order, without their
+// variants, images and attributes. The rows are streamed so the catalog is
+// never held in memory as a whole.
+func (s *Storage) ExportProducts(fn func(p *Product) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	query := `SELECT id, created_at, updated_at, COALESCE(sku, ''), name, description, price, quantity, options, status, publish_at, unpublish_at, version,
+			         ARRAY(SELECT category_id FROM products_categories WHERE product_id = products.id ORDER BY category_id)
+			  FROM products
+			  ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		p := Product{}
+		err := rows.Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt, &p.SKU, &p.Name, &p.Description, &p.Price, &p.Quantity, pq.Array(&p.Options),
+			&p.Status, &p.PublishAt, &p.UnpublishAt, &p.Version, pq.Array(&p.CategoryIDs))
+		if err != nil {
+			return err
+		}
+		err = fn(&p)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Storage) CreateProductImport(pi *ProductImport) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO product_imports(user_id, format, dry_run, status, total_rows)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING id, created_at, updated_at`
+
+	if pi.Errors == nil {
+		pi.Errors = []ProductImportError{}
+	}
+	args := []any{pi.UserID, pi.Format, pi.DryRun, pi.Status, pi.TotalRows}
+	return s.db.QueryRowContext(ctx, query, args...).Scan(&pi.ID, &pi.CreatedAt, &pi.UpdatedAt)
+}
+
+func (s *Storage) GetProductImportByID(id int64) (*ProductImport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT created_at, updated_at, finished_at, user_id, format, dry_run, status,
+			         total_rows, processed_rows, created_rows, updated_rows, failed_rows, errors, error
+			  FROM product_imports
+			  WHERE id = $1`
+
+	pi := ProductImport{
+		ID: id,
+	}
+	var errs []byte
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&pi.CreatedAt, &pi.UpdatedAt, &pi.FinishedAt, &pi.UserID, &pi.Format, &pi.DryRun, &pi.Status,
+		&pi.TotalRows, &pi.ProcessedRows, &pi.CreatedRows, &pi.UpdatedRows, &pi.FailedRows, &errs, &pi.Error)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(errs, &pi.Errors)
+	if err != nil {
+		return nil, err
+	}
+	return &pi, nil
+}
+
+// UpdateProductImport saves the progress of the import.
+func (s *Storage) UpdateProductImport(pi *ProductImport) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE product_imports
+			  SET status = $1, processed_rows = $2, created_rows = $3, updated_rows = $4, failed_rows = $5, errors = $6, error = $7,
+			      finished_at = $8, updated_at = NOW()
+			  WHERE id = $9
+			  RETURNING updated_at`
+
+	errs, err := json.Marshal(pi.Errors)
+	if err != nil {
+		return err
+	}
+	args := []any{pi.Status, pi.ProcessedRows, pi.CreatedRows, pi.UpdatedRows, pi.FailedRows, errs, pi.Error, pi.FinishedAt, pi.ID}
+	return s.db.QueryRowContext(ctx, query, args...).Scan(&pi.UpdatedAt)
+}
+
+var (
+	ErrDuplicateSKU = errors.New("a variant with this sku already exists")
+	// ErrDuplicateVariantOptions is returned when the product already has a
+	// variant with the same option values.
+	ErrDuplicateVariantOptions = errors.New("a variant with these options already exists")
+)
+
+func variantUniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	if pqErr.Constraint == "product_variants_options_index" {
+		return ErrDuplicateVariantOptions
+	}
+	return ErrDuplicateSKU
+}
+
+// CreateProductVariant adds the variant and records it in the history of its
+// product as added by the user.
+func (s *Storage) CreateProductVariant(v *ProductVariant, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO product_variants(product_id, sku, options, price, quantity)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING id, created_at, updated_at, version`
+
+	args := []any{v.ProductID, v.SKU, v.Options, v.Price, v.Quantity}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&v.ID, &v.CreatedAt, &v.UpdatedAt, &v.Version)
+	if err != nil {
+		tx.Rollback()
+		return variantUniqueViolation(err)
+	}
+
+	err = recordProductFieldChanges(ctx, tx, v.ProductID, userID, nil, variantHistoryFields(v))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const selectProductVariants = `SELECT id, created_at, updated_at, product_id, sku, options, price, quantity, version
+							   FROM product_variants`
+
+func scanProductVariant(scan func(dest ...any) error) (ProductVariant, error) {
+	v := ProductVariant{}
+	err := scan(&v.ID, &v.CreatedAt, &v.UpdatedAt, &v.ProductID, &v.SKU, &v.Options, &v.Price, &v.Quantity, &v.Version)
+	return v, err
+}
+
+func (s *Storage) GetProductVariantByID(id int64) (*ProductVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectProductVariants + " WHERE id = $1"
+
+	v, err := scanProductVariant(s.db.QueryRowContext(ctx, query, id).Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (s *Storage) GetProductVariants(productID int64) ([]ProductVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectProductVariants + " WHERE product_id = $1 ORDER BY id ASC"
+
+	rows, err := s.db.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	variants := []ProductVariant{}
+	for rows.Next() {
+		v, err := scanProductVariant(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// UpdateProductVariant saves the variant and records the changed fields in
+// the history of its product as changed by the user.
+func (s *Storage) UpdateProductVariant(v *ProductVariant, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query0 := selectProductVariants + " WHERE id = $1 FOR UPDATE"
+
+	before, err := scanProductVariant(tx.QueryRowContext(ctx, query0, v.ID).Scan)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query1 := `UPDATE product_variants
+			   SET sku = $1, options = $2, price = $3, quantity = $4, updated_at = NOW(), version = version + 1
+			   WHERE id = $5 AND version = $6
+			   RETURNING updated_at, version`
+
+	args := []any{v.SKU, v.Options, v.Price, v.Quantity, v.ID, v.Version}
+	err = tx.QueryRowContext(ctx, query1, args...).Scan(&v.UpdatedAt, &v.Version)
+	if err != nil {
+		tx.Rollback()
+		return variantUniqueViolation(err)
+	}
+
+	err = recordProductFieldChanges(ctx, tx, v.ProductID, userID, variantHistoryFields(&before), variantHistoryFields(v))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteProductVariant deletes the variant and records its last state in the
+// history of its product as removed by the user.
+func (s *Storage) DeleteProductVariant(v *ProductVariant, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM product_variants
+			  WHERE id = $1
+			  RETURNING id, created_at, updated_at, product_id, sku, options, price, quantity, version`
+
+	before, err := scanProductVariant(tx.QueryRowContext(ctx, query, v.ID).Scan)
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	err = recordProductFieldChanges(ctx, tx, before.ProductID, userID, variantHistoryFields(&before), nil)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// productImagesHistoryFields returns the ids of the images of the product in
+// position order as they are recorded in its history.
+func productImagesHistoryFields(ctx context.Context, tx *sql.Tx, productID int64) (map[string]any, error) {
+	query := `SELECT id
+			  FROM product_images
+			  WHERE product_id = $1
+			  ORDER BY position, id`
+
+	rows, err := tx.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]any{"images": ids}, nil
+}
+
+// changeProductImages runs fn in a transaction and records how it changed the
+// images of the product in its history.
+func (s *Storage) changeProductImages(productID, userID int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lockProduct(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	before, err := productImagesHistoryFields(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = fn(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	after, err := productImagesHistoryFields(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = recordProductFieldChanges(ctx, tx, productID, userID, before, after)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) CreateProductImage(img *ProductImage, userID int64) error {
+	return s.changeProductImages(img.ProductID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		query := `INSERT INTO product_images(product_id, key, content_type, width, height, position)
+				  VALUES ($1, $2, $3, $4, $5, (SELECT COALESCE(MAX(position), 0) + 1 FROM product_images WHERE product_id = $1))
+				  RETURNING id, created_at, position`
+
+		args := []any{img.ProductID, img.Key, img.ContentType, img.Width, img.Height}
+		return tx.QueryRowContext(ctx, query, args...).Scan(&img.ID, &img.CreatedAt, &img.Position)
+	})
+}
+
+// GetProductsImages returns the images of the products ordered by position,
+// every requested product has an entry even when it has no images.
+func (s *Storage) GetProductsImages(productIDs ...int64) (map[int64][]ProductImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	images := make(map[int64][]ProductImage, len(productIDs))
+	for _, id := range productIDs {
+		images[id] = []ProductImage{}
+	}
+	if len(productIDs) == 0 {
+		return images, nil
+	}
+
+	query := `SELECT id, created_at, product_id, key, content_type, width, height, position
+			  FROM product_images
+			  WHERE product_id = ANY($1)
+			  ORDER BY product_id, position, id`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		img := ProductImage{}
+		err := rows.Scan(&img.ID, &img.CreatedAt, &img.ProductID, &img.Key, &img.ContentType, &img.Width, &img.Height, &img.Position)
+		if err != nil {
+			return nil, err
+		}
+		images[img.ProductID] = append(images[img.ProductID], img)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ReorderProductImages sets the position of each image of the product to its
+// index in imageIDs, which must contain every image of the product.
+func (s *Storage) ReorderProductImages(productID int64, imageIDs []int64, userID int64) error {
+	return s.changeProductImages(productID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		query := `UPDATE product_images
+				  SET position = o.position
+				  FROM unnest($2::bigint[]) WITH ORDINALITY as o(id, position)
+				  WHERE product_images.id = o.id AND product_images.product_id = $1`
+
+		_, err := tx.ExecContext(ctx, query, productID, pq.Array(imageIDs))
+		return err
+	})
+}
+
+func (s *Storage) DeleteProductImage(img *ProductImage, userID int64) error {
+	return s.changeProductImages(img.ProductID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		query := `DELETE FROM product_images
+				  WHERE id = $1`
+
+		_, err := tx.ExecContext(ctx, query, img.ID)
+		return err
+	})
+}
+
+var ErrDuplicateAttributeCode = errors.New("an attribute with this code already exists")
+
+func (s *Storage) CreateAttribute(a *Attribute) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO attributes(category_id, code, name, type, unit, enum_values)
+			  VALUES ($1, $2, $3, $4, $5, $6)
+			  RETURNING id, created_at, updated_at, version`
+
+	args := []any{a.CategoryID, a.Code, a.Name, a.Type, a.Unit, pq.Array(a.EnumValues)}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt, &a.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateAttributeCode
+		case isForeignKeyViolation(err):
+			return ErrUnknownCategory
+		}
+		return err
+	}
+	return nil
+}
+
+const selectAttributes = `SELECT id, created_at, updated_at, category_id, code, name, type, unit, enum_values, version
+						  FROM attributes`
+
+func scanAttribute(scan func(dest ...any) error) (Attribute, error) {
+	a := Attribute{}
+	err := scan(&a.ID, &a.CreatedAt, &a.UpdatedAt, &a.CategoryID, &a.Code, &a.Name, &a.Type, &a.Unit, pq.Array(&a.EnumValues), &a.Version)
+	return a, err
+}
+
+func (s *Storage) GetAttributeByID(id int64) (*Attribute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectAttributes + " WHERE id = $1"
+
+	a, err := scanAttribute(s.db.QueryRowContext(ctx, query, id).Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *Storage) getAttributes(query string, args ...any) ([]Attribute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	attributes := []Attribute{}
+	for rows.Next() {
+		a, err := scanAttribute(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// GetAttributes returns every attribute when categoryID is zero, otherwise the
+// attributes applying to the products of the category.
+func (s *Storage) GetAttributes(categoryID int64) ([]Attribute, error) {
+	if categoryID == 0 {
+		return s.getAttributes(selectAttributes + " ORDER BY code")
+	}
+	query := `WITH RECURSIVE tree AS (
+				  SELECT id, parent_id FROM categories WHERE id = $1
+				  UNION
+				  SELECT c.id, c.parent_id FROM categories as c INNER JOIN tree ON c.id = tree.parent_id
+			  )
+			  ` + selectAttributes + `
+			  WHERE category_id IS NULL OR category_id IN (SELECT id FROM tree)
+			  ORDER BY code`
+	return s.getAttributes(query, categoryID)
+}
+
+func (s *Storage) GetAttributesByCodes(codes []string) ([]Attribute, error) {
+	return s.getAttributes(selectAttributes+" WHERE code = ANY($1) ORDER BY code", pq.Array(codes))
+}
+
+// GetApplicableAttributes returns the attributes that can be set on the product,
+// the global ones and those of its categories and their ancestors.
+func (s *Storage) GetApplicableAttributes(productID int64) ([]Attribute, error) {
+	query := `WITH RECURSIVE tree AS (
+				  SELECT c.id, c.parent_id
+				  FROM categories as c
+				  INNER JOIN products_categories as pc ON pc.category_id = c.id
+				  WHERE pc.product_id = $1
+				  UNION
+				  SELECT c.id, c.parent_id FROM categories as c INNER JOIN tree ON c.id = tree.parent_id
+			  )
+			  ` + selectAttributes + `
+			  WHERE category_id IS NULL OR category_id IN (SELECT id FROM tree)
+			  ORDER BY code`
+	return s.getAttributes(query, productID)
+}
+
+// UpdateAttribute saves everything but the type, which cannot change once
+// products have values of it.
+func (s *Storage) UpdateAttribute(a *Attribute) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE attributes
+			  SET category_id = $1, code = $2, name = $3, unit = $4, enum_values = $5, updated_at = NOW(), version = version + 1
+			  WHERE id = $6 AND version = $7
+			  RETURNING updated_at, version`
+
+	args := []any{a.CategoryID, a.Code, a.Name, a.Unit, pq.Array(a.EnumValues), a.ID, a.Version}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&a.UpdatedAt, &a.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateAttributeCode
+		case isForeignKeyViolation(err):
+			return ErrUnknownCategory
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) DeleteAttribute(a *Attribute) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM attributes
+			  WHERE id = $1`
+
+	_, err := s.db.ExecContext(ctx, query, a.ID)
+	return err
+}
+
+// SetProductAttributes sets the values on the product and removes the values
+// of the removed attributes, the changed values are recorded in the history of
+// the product as changed by the user.
+func (s *Storage) SetProductAttributes(productID int64, values []AttributeValue, removed []int64, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lockProduct(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	before, err := getProductAttributes(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query0 := `DELETE FROM product_attributes
+			   WHERE product_id = $1 AND attribute_id = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query0, productID, pq.Array(removed))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query1 := `INSERT INTO product_attributes(product_id, attribute_id, value_text, value_number, value_boolean)
+			   VALUES ($1, $2, $3, $4, $5)
+			   ON CONFLICT (product_id, attribute_id) DO UPDATE
+			   SET value_text = EXCLUDED.value_text, value_number = EXCLUDED.value_number, value_boolean = EXCLUDED.value_boolean`
+
+	for _, v := range values {
+		_, err = tx.ExecContext(ctx, query1, productID, v.AttributeID, v.Text, v.Number, v.Boolean)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	after, err := getProductAttributes(ctx, tx, productID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = recordProductFieldChanges(ctx, tx, productID, userID, attributeHistoryFields(before), attributeHistoryFields(after))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getProductAttributes reads the attribute values of the product keyed by
+// attribute code within the transaction.
+func getProductAttributes(ctx context.Context, tx *sql.Tx, productID int64) (map[string]any, error) {
+	query := `SELECT a.code, pa.value_text, pa.value_number, pa.value_boolean
+			  FROM product_attributes as pa
+			  INNER JOIN attributes as a ON a.id = pa.attribute_id
+			  WHERE pa.product_id = $1`
+
+	rows, err := tx.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	attributes := map[string]any{}
+	for rows.Next() {
+		var code string
+		var text sql.NullString
+		var number decimal.NullDecimal
+		var boolean sql.NullBool
+		err := rows.Scan(&code, &text, &number, &boolean)
+		if err != nil {
+			return nil, err
+		}
+		if value := attributeValue(text, number, boolean); value != nil {
+			attributes[code] = value
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// attributeValue returns the value of an attribute from the column matching
+// its type, the others are null.
+func attributeValue(text sql.NullString, number decimal.NullDecimal, boolean sql.NullBool) any {
+	switch {
+	case text.Valid:
+		return text.String
+	case number.Valid:
+		return number.Decimal
+	case boolean.Valid:
+		return boolean.Bool
+	}
+	return nil
+}
+
+// GetProductsAttributes returns the attribute values of the products keyed by
+// attribute code, every requested product has an entry.
+func (s *Storage) GetProductsAttributes(productIDs ...int64) (map[int64]map[string]any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	attributes := make(map[int64]map[string]any, len(productIDs))
+	for _, id := range productIDs {
+		attributes[id] = map[string]any{}
+	}
+	if len(productIDs) == 0 {
+		return attributes, nil
+	}
+
+	query := `SELECT pa.product_id, a.code, pa.value_text, pa.value_number, pa.value_boolean
+			  FROM product_attributes as pa
+			  INNER JOIN attributes as a ON a.id = pa.attribute_id
+			  WHERE pa.product_id = ANY($1)`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var productID int64
+		var code string
+		var text sql.NullString
+		var number decimal.NullDecimal
+		var boolean sql.NullBool
+		err := rows.Scan(&productID, &code, &text, &number, &boolean)
+		if err != nil {
+			return nil, err
+		}
+		if value := attributeValue(text, number, boolean); value != nil {
+			attributes[productID][code] = value
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+var (
+	ErrDuplicateSlug = errors.New("a category with this slug already exists")
+	ErrCategoryCycle = errors.New("a category cannot be moved below itself")
+	// ErrCategoryHasChildren is returned when deleting a category that still
+	// has subcategories.
+	ErrCategoryHasChildren = errors.New("category still has subcategories")
+)
+
+func (s *Storage) CreateCategory(c *Category) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO categories(parent_id, name, slug, description)
+			  VALUES ($1, $2, $3, $4)
+			  RETURNING id, created_at, updated_at, version`
+
+	args := []any{c.ParentID, c.Name, c.Slug, c.Description}
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateSlug
+		case isForeignKeyViolation(err):
+			return ErrUnknownCategory
+		}
+		return err
+	}
+	return nil
+}
+
+const selectCategories = `SELECT id, created_at, updated_at, parent_id, name, slug, description, version
+						  FROM categories`
+
+func scanCategory(scan func(dest ...any) error) (Category, error) {
+	c := Category{}
+	err := scan(&c.ID, &c.CreatedAt, &c.UpdatedAt, &c.ParentID, &c.Name, &c.Slug, &c.Description, &c.Version)
+	return c, err
+}
+
+func (s *Storage) getCategory(where string, arg any) (*Category, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectCategories + " WHERE " + where
+
+	c, err := scanCategory(s.db.QueryRowContext(ctx, query, arg).Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Storage) GetCategoryByID(id int64) (*Category, error) {
+	return s.getCategory("id = $1", id)
+}
+
+func (s *Storage) GetCategoryBySlug(slug string) (*Category, error) {
+	return s.getCategory("slug = $1", slug)
+}
+
+func (s *Storage) GetCategories() ([]Category, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectCategories + " ORDER BY name, id"
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	categories := []Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// GetCategoryPath returns the ancestors of the category starting at the root,
+// the category itself is not included.
+func (s *Storage) GetCategoryPath(c *Category) ([]Category, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	// the depth makes every row distinct, so visited stops the walk should the
+	// tree ever contain a cycle
+	query := `WITH RECURSIVE path AS (
+				  SELECT c.*, 1 as depth, ARRAY[c.id] as visited FROM categories as c WHERE c.id = $1
+				  UNION
+				  SELECT c.*, path.depth + 1, path.visited || c.id FROM categories as c INNER JOIN path ON c.id = path.parent_id
+				  WHERE c.id <> ALL(path.visited)
+			  )
+			  SELECT id, created_at, updated_at, parent_id, name, slug, description, version
+			  FROM path
+			  ORDER BY depth DESC`
+
+	path := []Category{}
+	if c.ParentID == nil {
+		return path, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, *c.ParentID)
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
 		_ = rows.Close()
 	}()
-	total := 0
-	products := []Product{}
+
 	for rows.Next() {
-		p := Product{}
-		err := rows.Scan(&total, &p.ID, &p.CreatedAt, &p.UpdatedAt, &p.Name, &p.Description, &p.Price, &p.Quantity, &p.Version)
+		a, err := scanCategory(rows.Scan)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
-		products = append(products, p)
+		path = append(path, a)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, 0, err
+
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-	return products, total, nil
+	return path, nil
 }
 
-func (s *Storage) UpdateProduct(p *Product) error {
+// UpdateCategory saves the category. Moving a category below itself or one of
+// its descendants returns ErrCategoryCycle.
+func (s *Storage) UpdateCategory(c *Category) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `UPDATE products
-	          SET name = $1, description = $2, price = $3, quantity = $4, updated_at = NOW(), version = version + 1
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.ParentID != nil {
+		// two concurrent moves could each pass the check and form a cycle
+		// together, so moves are serialized. Reads are not blocked.
+		_, err = tx.ExecContext(ctx, "LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		query := `WITH RECURSIVE ancestors AS (
+					  SELECT id, parent_id FROM categories WHERE id = $1
+					  UNION
+					  SELECT c.id, c.parent_id FROM categories as c INNER JOIN ancestors as a ON c.id = a.parent_id
+				  )
+				  SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)`
+
+		cycle := false
+		err = tx.QueryRowContext(ctx, query, *c.ParentID, c.ID).Scan(&cycle)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if cycle {
+			tx.Rollback()
+			return ErrCategoryCycle
+		}
+	}
+
+	query := `UPDATE categories
+			  SET parent_id = $1, name = $2, slug = $3, description = $4, updated_at = NOW(), version = version + 1
 			  WHERE id = $5 AND version = $6
-			  RETURNING version`
+			  RETURNING updated_at, version`
 
-	args := []any{p.Name, p.Description, p.Price, p.Quantity, p.ID, p.Version}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&p.Version)
+	args := []any{c.ParentID, c.Name, c.Slug, c.Description, c.ID, c.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&c.UpdatedAt, &c.Version)
 	if err != nil {
+		tx.Rollback()
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateSlug
+		case isForeignKeyViolation(err):
+			return ErrUnknownCategory
+		}
 		return err
 	}
-	return nil
+
+	return tx.Commit()
 }
 
-func (s *Storage) DeleteProduct(p *Product) error {
+func (s *Storage) DeleteCategory(c *Category) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `DELETE FROM products
+	query := `DELETE FROM categories
 			  WHERE id = $1`
 
-	args := []any{p.ID}
-	_, err := s.db.ExecContext(ctx, query, args...)
-	return err
+	_, err := s.db.ExecContext(ctx, query, c.ID)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrCategoryHasChildren
+		}
+		return err
+	}
+	return nil
 }
 
-func (s *Storage) CreateCartItem(productID int64, userID int64, quantity int64) (*CartItem, error) {
+func (s *Storage) CreateCartItem(productID int64, variantID *int64, userID int64, quantity int64) (*CartItem, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `INSERT INTO cart_items(product_id, user_id, quantity)
-			  VALUES ($1, $2, $3)
+	query := `INSERT INTO cart_items(product_id, variant_id, user_id, quantity)
+			  VALUES ($1, $2, $3, $4)
 			  RETURNING id`
 
 	c := CartItem{
 		ProductID: productID,
+		VariantID: variantID,
 		UserID:    userID,
 		Quantity:  quantity,
 	}
 
-	args := []any{productID, userID, quantity}
+	args := []any{productID, variantID, userID, quantity}
 	err := s.db.QueryRowContext(ctx, query, args...).Scan(&c.ID)
 	if err != nil {
 		return nil, err
@@ -394,7 +3489,7 @@ func (s *Storage) GetCartItemById(cartItemID int64) (*CartItem, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT product_id, user_id, quantity, version
+	query := `SELECT product_id, variant_id, user_id, quantity, version
 			  FROM cart_items
 			  WHERE id = $1`
 
@@ -403,7 +3498,7 @@ func (s *Storage) GetCartItemById(cartItemID int64) (*CartItem, error) {
 	}
 
 	args := []any{cartItemID}
-	err := s.db.QueryRowContext(ctx, query, args...).Scan(&item.ProductID, &item.UserID, &item.Quantity, &item.Version)
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&item.ProductID, &item.VariantID, &item.UserID, &item.Quantity, &item.Version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -417,7 +3512,7 @@ func (s *Storage) GetCartItems(userID int64) ([]CartItem, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT id, product_id, quantity, version
+	query := `SELECT id, product_id, variant_id, quantity, version
 			  FROM cart_items
 			  WHERE user_id = $1
 			  ORDER BY id ASC`
@@ -438,7 +3533,7 @@ func (s *Storage) GetCartItems(userID int64) ([]CartItem, error) {
 		item := CartItem{
 			UserID: userID,
 		}
-		err := rows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Version)
+		err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Quantity, &item.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -507,10 +3602,14 @@ func (s *Storage) CheckoutCart(u *User) (decimal.Decimal, int64, error) {
 	if err != nil {
 		return decimal.Zero, 0, err
 	}
-	query0 := `SELECT c.id, c.quantity, c.version, p.id, p.name, p.price, p.quantity, p.version 
+	query0 := `SELECT c.id, c.quantity, c.version, p.id, p.name, p.price, p.quantity, p.status, p.version,
+			          EXISTS (SELECT 1 FROM product_variants WHERE product_id = p.id),
+			          v.id, v.sku, v.price, v.quantity, v.version
 			   FROM cart_items as c
 			   INNER JOIN products as p
 			   ON c.product_id = p.id
+			   LEFT JOIN product_variants as v
+			   ON c.variant_id = v.id
 			   WHERE c.user_id = $1`
 
 	rows, err := tx.QueryContext(ctx, query0, u.ID)
@@ -527,6 +3626,9 @@ func (s *Storage) CheckoutCart(u *User) (decimal.Decimal, int64, error) {
 		Quantity int64
 		Version  int32
 		Product  Product
+		// Variant is nil for products that are sold without variants.
+		Variant *ProductVariant
+		Price   decimal.Decimal
 	}
 
 	items := []cartItemCheckout{}
@@ -534,17 +3636,53 @@ func (s *Storage) CheckoutCart(u *User) (decimal.Decimal, int64, error) {
 	for rows.Next() {
 		item := cartItemCheckout{}
 		p := &item.Product
-		err := rows.Scan(&item.ID, &item.Quantity, &item.Version, &p.ID, &p.Name, &p.Price, &p.Quantity, &p.Version)
+		var variantID, variantQuantity sql.NullInt64
+		var variantVersion sql.NullInt32
+		var variantSKU sql.NullString
+		var variantPrice decimal.NullDecimal
+		var hasVariants bool
+		err := rows.Scan(&item.ID, &item.Quantity, &item.Version, &p.ID, &p.Name, &p.Price, &p.Quantity, &p.Status, &p.Version,
+			&hasVariants, &variantID, &variantSKU, &variantPrice, &variantQuantity, &variantVersion)
 		if err != nil {
 			tx.Rollback()
 			return decimal.Zero, 0, err
 		}
-		if item.Quantity > p.Quantity {
+
+		if p.Status != ProductPublished {
+			tx.Rollback()
+			return decimal.Zero, 0, fmt.Errorf("product %d-%v is no longer available", p.ID, p.Name)
+		}
+		// items added before the product got variants have none, the stock
+		// of the product itself is no longer used
+		if hasVariants && !variantID.Valid {
+			tx.Rollback()
+			return decimal.Zero, 0, fmt.Errorf("product %d-%v now has variants, select a variant", p.ID, p.Name)
+		}
+
+		item.Price = p.Price
+		stock := p.Quantity
+		if variantID.Valid {
+			item.Variant = &ProductVariant{
+				ID:        variantID.Int64,
+				ProductID: p.ID,
+				SKU:       variantSKU.String,
+				Quantity:  variantQuantity.Int64,
+				Version:   variantVersion.Int32,
+			}
+			if variantPrice.Valid {
+				item.Price = variantPrice.Decimal
+			}
+			stock = item.Variant.Quantity
+		}
+		if item.Quantity > stock {
 			tx.Rollback()
-			return decimal.Zero, 0, errors.New("product %d-%v has only %d in stock and you want %d")
+			if item.Variant != nil {
+				return decimal.Zero, 0, fmt.Errorf("product %d-%v variant %s has only %d in stock and you want %d", p.ID, p.Name, item.Variant.SKU, stock, item.Quantity)
+			}
+			return decimal.Zero, 0, fmt.Errorf("product %d-%v has only %d in stock and you want %d", p.ID, p.Name, stock, item.Quantity)
 		}
 		items = append(items, item)
-		total = total.Add(item.Product.Price.Mul(decimal.NewFromInt(item.Quantity)))
+		total = total.Add(item.Price.Mul(decimal.NewFromInt(item.Quantity)))
 	}
 	if err = rows.Err(); err != nil {
 		tx.Rollback()
@@ -565,8 +3703,16 @@ func (s *Storage) CheckoutCart(u *User) (decimal.Decimal, int64, error) {
 			   SET quantity = quantity - $1, version = version + 1
 			   WHERE id = $2 AND version = $3`
 
+	query1v := `UPDATE product_variants
+			    SET quantity = quantity - $1, updated_at = NOW(), version = version + 1
+			    WHERE id = $2 AND version = $3`
+
 	for _, item := range items {
-		_, err = tx.ExecContext(ctx, query1, item.Quantity, item.Product.ID, item.Product.Version)
+		if item.Variant != nil {
+			_, err = tx.ExecContext(ctx, query1v, item.Quantity, item.Variant.ID, item.Variant.Version)
+		} else {
+			_, err = tx.ExecContext(ctx, query1, item.Quantity, item.Product.ID, item.Product.Version)
+		}
 		if err != nil {
 			tx.Rollback()
 			return decimal.Zero, 0, err
@@ -594,11 +3740,15 @@ func (s *Storage) CheckoutCart(u *User) (decimal.Decimal, int64, error) {
 		return decimal.Zero, 0, err
 	}
 
-	query4 := `INSERT INTO order_items(order_id, product_id, quantity, price)
-			   VALUES ($1, $2, $3, $4)`
+	query4 := `INSERT INTO order_items(order_id, product_id, variant_id, quantity, price)
+			   VALUES ($1, $2, $3, $4, $5)`
 
 	for _, item := range items {
-		_, err = tx.ExecContext(ctx, query4, orderID, item.Product.ID, item.Quantity, item.Product.Price)
+		var variantID *int64
+		if item.Variant != nil {
+			variantID = &item.Variant.ID
+		}
+		_, err = tx.ExecContext(ctx, query4, orderID, item.Product.ID, variantID, item.Quantity, item.Price)
 		if err != nil {
 			tx.Rollback()
 			return decimal.Zero, 0, err
@@ -702,7 +3852,7 @@ func (s *Storage) GetOrderItems(orderID int64) ([]OrderItem, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT id, product_id, quantity, price
+	query := `SELECT id, product_id, variant_id, quantity, price
 	          FROM order_items
 			  WHERE order_id = $1
 			  ORDER BY id ASC`
@@ -726,7 +3876,7 @@ func (s *Storage) GetOrderItems(orderID int64) ([]OrderItem, error) {
 		item := OrderItem{
 			OrderID: orderID,
 		}
-		err = rows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Price)
+		err = rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Quantity, &item.Price)
 		if err != nil {
 			return nil, err
 		}
@@ -744,14 +3894,53 @@ func (s *Storage) GetOrdersItems(userID int64) ([]OrderItems, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
 
-	query := `SELECT o.id, o.created_at, o.status_id, o.completed_at, o.version, i.id, i.product_id, i.quantity, i.price
+	query := `SELECT o.id, o.created_at, o.status_id, o.completed_at, o.version, i.id, i.product_id, i.variant_id, i.quantity, i.price
 	          FROM orders as o
 			  INNER JOIN order_items as i
 			  ON i.order_id = o.id
 			  WHERE user_id = $1
 			  ORDER BY o.id ASC, i.id ASC`
 
-	args := []any{userID}
+	return s.getOrdersItems(ctx, query, userID)
+}
+
+// GetOrdersItemsPage returns the page of orders of the user after the cursor,
+// or the first page when it is nil. sort is either "id" or "-id".
+func (s *Storage) GetOrdersItemsPage(userID int64, sort string, c *Cursor, pageSize int) ([]OrderItems, Pagination, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	k := keyset{column: "id", typ: "bigint", desc: sort == "-id"}
+	where := &whereBuilder{}
+	where.add(fmt.Sprintf("user_id = %s", where.arg(userID)))
+	order := k.apply(where, c, "id")
+	limit := where.arg(pageSize + 1)
+	query := fmt.Sprintf(`SELECT o.id, o.created_at, o.status_id, o.completed_at, o.version, i.id, i.product_id, i.variant_id, i.quantity, i.price
+	                      FROM (
+	                          SELECT * FROM orders
+	                          WHERE %s
+	                          ORDER BY %s
+	                          LIMIT %s
+	                      ) as o
+	                      INNER JOIN order_items as i
+	                      ON i.order_id = o.id
+	                      ORDER BY o.%s, i.id ASC`, where, order, limit, order)
+
+	orders, err := s.getOrdersItems(ctx, query, where.args...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	keyed := make([]keyedRow[OrderItems], len(orders))
+	for i := range orders {
+		keyed[i] = keyedRow[OrderItems]{row: orders[i], id: orders[i].Order.ID}
+	}
+	page, pagination := paginate(keyed, c, sort, pageSize)
+	return page, pagination, nil
+}
+
+// getOrdersItems groups the rows of an orders and order_items join by order,
+// the rows must be ordered by order.
+func (s *Storage) getOrdersItems(ctx context.Context, query string, args ...any) ([]OrderItems, error) {
 	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -768,7 +3957,7 @@ func (s *Storage) GetOrdersItems(userID int64) ([]OrderItems, error) {
 	for rows.Next() {
 		o := Order{}
 		i := OrderItem{}
-		err = rows.Scan(&o.ID, &o.CreatedAt, &o.StatusID, &o.CompletedAt, &o.Version, &i.ID, &i.ProductID, &i.Quantity, &i.Price)
+		err = rows.Scan(&o.ID, &o.CreatedAt, &o.StatusID, &o.CompletedAt, &o.Version, &i.ID, &i.ProductID, &i.VariantID, &i.Quantity, &i.Price)
 		if err != nil {
 			return nil, err
 		}
@@ -908,6 +4097,45 @@ func (s *Storage) GetTransationWithSignature(signature string) (*Transation, err
 	return &t, nil
 }
 
+func (s *Storage) GetTransations(userID int64) ([]Transation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT id, signature, amount
+	          FROM transations
+			  WHERE user_id = $1
+			  ORDER BY id ASC`
+
+	args := []any{userID}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	transations := []Transation{}
+
+	for rows.Next() {
+		t := Transation{
+			UserID: userID,
+		}
+		err = rows.Scan(&t.ID, &t.Signature, &t.Amount)
+		if err != nil {
+			return nil, err
+		}
+		transations = append(transations, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transations, nil
+}
+
 func (s *Storage) TransferToUser(u *User, signature string, amount decimal.Decimal) error {
 	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
 	defer cancel()
@@ -949,14 +4177,32 @@ func (s *Storage) TransferToUser(u *User, signature string, amount decimal.Decim
 }
 
 func (s *Storage) GetUserPermissions(userID int64) (Permissions, error) {
+	p, generation, ok := s.permissions.Get(userID)
+	if ok {
+		return p, nil
+	}
+	p, err := s.getUserPermissions(userID)
+	if err != nil {
+		return nil, err
+	}
+	s.permissions.Set(userID, p, generation)
+	return p, nil
+}
+
+func (s *Storage) getUserPermissions(userID int64) (Permissions, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	query := `SELECT p.code
 	          FROM permissions as p
 			  INNER JOIN users_permissions as up ON p.id = up.permission_id
-			  INNER JOIN users as u ON u.id = up.user_id
-			  WHERE u.id = $1`
+			  WHERE up.user_id = $1
+			  UNION
+			  SELECT p.code
+			  FROM permissions as p
+			  INNER JOIN roles_permissions as rp ON p.id = rp.permission_id
+			  INNER JOIN users_roles as ur ON ur.role_id = rp.role_id
+			  WHERE ur.user_id = $1`
 
 	args := []any{userID}
 	rows, err := s.db.QueryContext(ctx, query, args...)
@@ -989,12 +4235,244 @@ func (s *Storage) GetUserPermissions(userID int64) (Permissions, error) {
 	return p, nil
 }
 
+func (s *Storage) GetAllPermissions() (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT code
+			  FROM permissions
+			  ORDER BY code ASC`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	p := Permissions{}
+
+	for rows.Next() {
+		var code string
+		err = rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
 func (s *Storage) GrantPermissions(userID int64, codes ...string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	query := `INSERT INTO users_permissions
-	          SELECT $1, p.id FROM permissions as p WHERE p.code = ANY($2)`
-	args := []any{pq.Array(codes)}
+	          SELECT $1, p.id FROM permissions as p WHERE p.code = ANY($2)
+			  ON CONFLICT DO NOTHING`
+	args := []any{userID, pq.Array(codes)}
 	_, err := s.db.ExecContext(ctx, query, args...)
-	return err
+	if err != nil {
+		return err
+	}
+	s.permissions.Invalidate(userID)
+	return nil
+}
+
+func (s *Storage) RevokePermissions(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+	query := `DELETE FROM users_permissions as up
+			  USING permissions as p
+			  WHERE up.permission_id = p.id AND up.user_id = $1 AND p.code = ANY($2)`
+	args := []any{userID, pq.Array(codes)}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	s.permissions.Invalidate(userID)
+	return nil
+}
+
+var ErrDuplicateRole = errors.New("a role with this name already exists")
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (s *Storage) CreateRole(name string, codes Permissions) (*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	query0 := `INSERT INTO roles(name)
+			   VALUES ($1)
+			   RETURNING id, created_at`
+
+	role := Role{
+		Name:        name,
+		Permissions: codes,
+	}
+	err = tx.QueryRowContext(ctx, query0, name).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicateRole
+		}
+		return nil, err
+	}
+
+	query1 := `INSERT INTO roles_permissions
+			   SELECT $1, p.id FROM permissions as p WHERE p.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query1, role.ID, pq.Array(codes))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+const selectRoles = `SELECT r.id, r.created_at, r.name, COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+					 FROM roles as r
+					 LEFT JOIN roles_permissions as rp ON rp.role_id = r.id
+					 LEFT JOIN permissions as p ON p.id = rp.permission_id`
+
+func scanRole(scan func(dest ...any) error) (Role, error) {
+	role := Role{}
+	codes := []string{}
+	err := scan(&role.ID, &role.CreatedAt, &role.Name, pq.Array(&codes))
+	role.Permissions = codes
+	return role, err
+}
+
+func (s *Storage) GetRoleByID(id int64) (*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := selectRoles + `
+			  WHERE r.id = $1
+			  GROUP BY r.id`
+
+	role, err := scanRole(s.db.QueryRowContext(ctx, query, id).Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (s *Storage) getRoles(query string, args ...any) ([]Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s *Storage) GetRoles() ([]Role, error) {
+	query := selectRoles + `
+			  GROUP BY r.id
+			  ORDER BY r.id ASC`
+	return s.getRoles(query)
+}
+
+func (s *Storage) GetUserRoles(userID int64) ([]Role, error) {
+	query := selectRoles + `
+			  INNER JOIN users_roles as ur ON ur.role_id = r.id
+			  WHERE ur.user_id = $1
+			  GROUP BY r.id
+			  ORDER BY r.id ASC`
+	return s.getRoles(query, userID)
+}
+
+func (s *Storage) DeleteRole(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM roles
+			  WHERE id = $1`
+
+	args := []any{role.ID}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	s.permissions.InvalidateAll()
+	return nil
+}
+
+func (s *Storage) AssignRole(userID, roleID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `INSERT INTO users_roles(user_id, role_id)
+			  VALUES ($1, $2)
+			  ON CONFLICT DO NOTHING`
+
+	args := []any{userID, roleID}
+	_, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	s.permissions.Invalidate(userID)
+	return nil
+}
+
+func (s *Storage) RevokeRole(userID, roleID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+
+	query := `DELETE FROM users_roles
+			  WHERE user_id = $1 AND role_id = $2`
+
+	args := []any{userID, roleID}
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	s.permissions.Invalidate(userID)
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
 }
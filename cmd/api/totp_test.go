@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238 appendix B, cut to the last six digits
+// since the codes are six digits long.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got := totpCode(key, totpStep(time.Unix(tt.unix, 0)))
+		if got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+		step   int64
+	}{
+		{"current step", secret, "050471", true, totpStep(now)},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", true, totpStep(now)},
+		{"previous step", secret, totpCode([]byte("12345678901234567890"), totpStep(now)-1), true, totpStep(now) - 1},
+		{"next step", secret, totpCode([]byte("12345678901234567890"), totpStep(now)+1), true, totpStep(now) + 1},
+		{"outside the skew", secret, totpCode([]byte("12345678901234567890"), totpStep(now)-2), false, 0},
+		{"wrong code", secret, "000000", false, 0},
+		{"invalid secret", "not base32!", "050471", false, 0},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(tt.secret, tt.code, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: validateTOTP = %d, %t, want %d, %t", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"encoding/base32"
 	"encoding/json"
+	"fmt"
 	"log"
 	"regexp"
+	"slices"
+	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+var attributeCodeRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var totpCodeRegexp = regexp.MustCompile(fmt.Sprintf(`^[0-9]{%d}$`, totpDigits))
+
 type Validator struct {
 	violations map[string]string
 }
@@ -42,6 +54,98 @@ func (v *Validator) CheckPassword(password string) {
 	v.Check(len(password) >= 8, "password", "must be atleast 8 characters")
 }
 
+func (v *Validator) CheckToken(token string) {
+	v.Check(token != "", "token", "must be provided")
+	v.Check(len(token) == base32.StdEncoding.WithPadding(base32.NoPadding).EncodedLen(16), "token", "must be valid")
+}
+
+func (v *Validator) CheckSlug(slug string) {
+	v.Check(slug != "", "slug", "must be provided")
+	v.Check(len(slug) <= 100, "slug", "must not be more than 100 characters")
+	v.Check(slugRegexp.MatchString(slug), "slug", "must only contain lowercase letters, digits and single dashes")
+}
+
+// CheckProduct checks a whole product, as the rows of a bulk import are.
+func (v *Validator) CheckProduct(p *Product) {
+	v.Check(p.Name != "", "name", "must be provided")
+	v.Check(len(p.Name) <= 50, "name", "must not be more than 50 characters")
+	v.Check(p.Description != "", "description", "must be provided")
+	v.Check(p.Price.GreaterThan(decimal.Zero), "price", "must be greater than zero")
+	v.Check(p.Quantity >= 0, "quantity", "must be greater than or equal zero")
+	v.Check(len(p.SKU) <= 64, "sku", "must not be more than 64 characters")
+	v.CheckProductOptions(p.Options)
+	v.CheckProductSchedule(p.Status, p.PublishAt, p.UnpublishAt)
+}
+
+// CheckProductSchedule checks the status of a product and its scheduled
+// changes, a draft can only be scheduled for publishing and a published
+// product for archiving.
+func (v *Validator) CheckProductSchedule(status ProductStatus, publishAt, unpublishAt *time.Time) {
+	v.Check(slices.Index(productStatuses, status) != -1, "status", `must be one of "draft", "published" or "archived"`)
+	if publishAt != nil {
+		v.Check(status == ProductDraft, "publish_at", `can only be set on "draft" products`)
+	}
+	if unpublishAt != nil {
+		v.Check(status != ProductArchived, "unpublish_at", `cannot be set on "archived" products`)
+		v.Check(publishAt == nil || unpublishAt.After(*publishAt), "unpublish_at", `must be after "publish_at"`)
+	}
+}
+
+func (v *Validator) CheckAttributeCode(code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 50, "code", "must not be more than 50 characters")
+	v.Check(attributeCodeRegexp.MatchString(code), "code", "must start with a lowercase letter followed by lowercase letters, digits or underscores")
+}
+
+func (v *Validator) CheckEnumValues(t AttributeType, values []string) {
+	if t != AttributeEnum {
+		v.Check(len(values) == 0, "enum_values", `must only be provided for "enum" attributes`)
+		return
+	}
+	v.Check(len(values) > 0, "enum_values", "must be provided")
+	v.Check(len(values) <= 100, "enum_values", "must not contain more than 100 values")
+	for i, value := range values {
+		v.Check(value != "", "enum_values", "must not contain empty values")
+		v.Check(slices.Index(values[:i], value) == -1, "enum_values", "must not contain duplicate values")
+	}
+}
+
+func (v *Validator) CheckSKU(sku string) {
+	v.Check(sku != "", "sku", "must be provided")
+	v.Check(len(sku) <= 64, "sku", "must not be more than 64 characters")
+}
+
+func (v *Validator) CheckProductOptions(options []string) {
+	v.Check(len(options) <= 5, "options", "must not contain more than 5 options")
+	for i, o := range options {
+		v.Check(o != "", "options", "must not contain empty options")
+		v.Check(len(o) <= 50, "options", "must not contain options of more than 50 characters")
+		v.Check(slices.Index(options[:i], o) == -1, "options", "must not contain duplicate options")
+	}
+}
+
+// CheckVariantOptions checks that the variant has exactly one value for each
+// option axis of its product.
+func (v *Validator) CheckVariantOptions(values VariantOptions, axes []string) {
+	v.Check(len(values) == len(axes), "options", fmt.Sprintf("must have a value for each of %q", axes))
+	for _, axis := range axes {
+		value, ok := values[axis]
+		v.Check(ok && value != "", "options", fmt.Sprintf("must have a value for each of %q", axes))
+	}
+}
+
+func (v *Validator) CheckTOTPCode(code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(totpCodeRegexp.MatchString(code), "code", fmt.Sprintf("must be %d digits", totpDigits))
+}
+
+func (v *Validator) CheckPermissions(codes []string, known Permissions) {
+	v.Check(len(codes) != 0, "permissions", "must be provided")
+	for _, code := range codes {
+		v.Check(known.Has(code), "permissions", fmt.Sprintf("unknown permission %q", code))
+	}
+}
+
 func (v *Validator) HasError() bool {
 	return len(v.violations) != 0
 }
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS tokens_hash_index;
+ALTER TABLE tokens DROP COLUMN IF EXISTS rotated_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family_id;
+DROP TABLE IF EXISTS token_families;
\ No newline at end of file
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS token_families (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bigint REFERENCES token_families(id) ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS rotated_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_hash_index ON tokens(hash);
\ No newline at end of file
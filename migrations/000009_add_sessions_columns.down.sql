@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS token_families_user_id_index;
+ALTER TABLE token_families DROP COLUMN IF EXISTS ip;
+ALTER TABLE token_families DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE token_families DROP COLUMN IF EXISTS last_used_at;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE token_families ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE token_families ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE token_families ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS token_families_user_id_index ON token_families(user_id);
\ No newline at end of file
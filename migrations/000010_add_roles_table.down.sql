@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+DELETE FROM permissions WHERE code IN ('orders:update', 'roles:read', 'roles:create', 'roles:delete', 'permissions:grant');
+ALTER TABLE permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
\ No newline at end of file
@@ -0,0 +1,43 @@
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+INSERT INTO permissions(code)
+VALUES
+('orders:update'),
+('roles:read'),
+('roles:create'),
+('roles:delete'),
+('permissions:grant')
+ON CONFLICT (code) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles(name)
+VALUES
+('customer'),
+('staff'),
+('admin');
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE (r.name = 'customer' AND p.code IN ('products:read'))
+   OR (r.name = 'staff' AND p.code IN ('products:create', 'products:read', 'products:update', 'products:delete', 'orders:update'))
+   OR r.name = 'admin';
+
+INSERT INTO users_roles
+SELECT u.id, r.id FROM users as u, roles as r WHERE r.name = 'customer';
\ No newline at end of file
@@ -0,0 +1 @@
+DELETE FROM permissions WHERE code = 'metrics:read';
\ No newline at end of file
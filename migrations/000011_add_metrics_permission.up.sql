@@ -0,0 +1,8 @@
+INSERT INTO permissions(code)
+VALUES ('metrics:read')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name = 'admin' AND p.code = 'metrics:read'
+ON CONFLICT DO NOTHING;
\ No newline at end of file
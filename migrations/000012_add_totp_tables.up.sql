@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS users_totp (
+    user_id bigint PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    secret text NOT NULL,
+    is_enabled boolean NOT NULL DEFAULT false,
+    last_used_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_index ON recovery_codes(user_id);
\ No newline at end of file
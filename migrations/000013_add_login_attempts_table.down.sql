@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'users:update';
+DROP TABLE IF EXISTS login_attempts;
\ No newline at end of file
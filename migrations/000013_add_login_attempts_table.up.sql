@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    email citext PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone
+);
+
+INSERT INTO permissions(code)
+VALUES ('users:update')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name = 'admin' AND p.code = 'users:update'
+ON CONFLICT DO NOTHING;
\ No newline at end of file
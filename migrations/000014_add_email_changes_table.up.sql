@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS email_changes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    old_email citext NOT NULL,
+    new_email citext NOT NULL,
+    confirmed_at timestamp(0) with time zone,
+    reverted_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS email_changes_user_id_index ON email_changes(user_id);
\ No newline at end of file
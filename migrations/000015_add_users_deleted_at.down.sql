@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_deleted_at_index;
+ALTER TABLE users DROP COLUMN IF EXISTS anonymized_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
\ No newline at end of file
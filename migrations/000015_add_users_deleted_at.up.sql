@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anonymized_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_index ON users(deleted_at) WHERE deleted_at IS NOT NULL AND anonymized_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state text PRIMARY KEY,
+    provider text NOT NULL,
+    code_verifier text NOT NULL,
+    nonce text NOT NULL,
+    expires_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider text NOT NULL,
+    subject text NOT NULL,
+    email citext NOT NULL,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_index ON user_identities(user_id);
\ No newline at end of file
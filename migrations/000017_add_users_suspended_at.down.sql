@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'users:read';
+ALTER TABLE users DROP COLUMN IF EXISTS suspended_at;
\ No newline at end of file
@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_at timestamp(0) with time zone;
+
+INSERT INTO permissions(code)
+VALUES ('users:read')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name IN ('admin', 'staff') AND p.code = 'users:read'
+ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    prefix text NOT NULL,
+    hash bytea NOT NULL UNIQUE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone,
+    expires_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_index ON api_keys(user_id);
+
+CREATE TABLE IF NOT EXISTS api_keys_permissions (
+    api_key_id bigint NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (api_key_id, permission_id)
+);
\ No newline at end of file
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS revoked_sessions (
+    session_id bigint PRIMARY KEY,
+    expires_at timestamp(0) with time zone NOT NULL
+);
\ No newline at end of file
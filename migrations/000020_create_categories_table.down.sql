@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('categories:create', 'categories:update', 'categories:delete');
+DROP TABLE IF EXISTS products_categories;
+DROP TABLE IF EXISTS categories;
\ No newline at end of file
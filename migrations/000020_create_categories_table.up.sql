@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    parent_id bigint REFERENCES categories(id) ON DELETE RESTRICT,
+    name varchar(50) NOT NULL,
+    slug text UNIQUE NOT NULL,
+    description text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_index ON categories(parent_id);
+
+CREATE TABLE IF NOT EXISTS products_categories (
+    product_id bigint NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    category_id bigint NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+    PRIMARY KEY (product_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS products_categories_category_id_index ON products_categories(category_id);
+
+INSERT INTO permissions(code)
+VALUES
+('categories:create'),
+('categories:update'),
+('categories:delete')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name IN ('admin', 'staff') AND p.code IN ('categories:create', 'categories:update', 'categories:delete')
+ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1,7 @@
+ALTER TABLE order_items DROP COLUMN IF EXISTS variant_id;
+DROP INDEX IF EXISTS unique_cart_item;
+DELETE FROM cart_items WHERE variant_id IS NOT NULL;
+ALTER TABLE cart_items DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE cart_items ADD CONSTRAINT unique_cart_item UNIQUE (product_id, user_id);
+DROP TABLE IF EXISTS product_variants;
+ALTER TABLE products DROP COLUMN IF EXISTS options;
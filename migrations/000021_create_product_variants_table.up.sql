@@ -0,0 +1,21 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS options text[] NOT NULL DEFAULT '{}';
+
+CREATE TABLE IF NOT EXISTS product_variants (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    product_id bigint NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku text UNIQUE NOT NULL,
+    options jsonb NOT NULL DEFAULT '{}',
+    price decimal(10, 2),
+    quantity bigint NOT NULL CHECK (quantity >= 0),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS product_variants_options_index ON product_variants(product_id, options);
+
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id bigint REFERENCES product_variants(id) ON DELETE CASCADE;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS unique_cart_item;
+CREATE UNIQUE INDEX IF NOT EXISTS unique_cart_item ON cart_items(product_id, user_id, COALESCE(variant_id, 0));
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_id bigint REFERENCES product_variants(id) ON DELETE SET NULL;
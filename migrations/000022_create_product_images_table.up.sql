@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS product_images (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    product_id bigint NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    key text UNIQUE NOT NULL,
+    content_type text NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    position integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS product_images_product_id_index ON product_images(product_id, position);
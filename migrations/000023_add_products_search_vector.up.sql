@@ -0,0 +1,7 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', name), 'A') ||
+        setweight(to_tsvector('english', description), 'B')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS products_search_vector_index ON products USING GIN (search_vector);
@@ -0,0 +1,2 @@
+DROP MATERIALIZED VIEW IF EXISTS product_words;
+DROP INDEX IF EXISTS products_name_trgm_index;
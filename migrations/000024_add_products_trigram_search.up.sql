@@ -0,0 +1,10 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS products_name_trgm_index ON products USING GIN (lower(name) gin_trgm_ops);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS product_words AS
+SELECT word, ndoc
+FROM ts_stat('SELECT to_tsvector(''simple'', name) || to_tsvector(''simple'', description) FROM products');
+
+CREATE UNIQUE INDEX IF NOT EXISTS product_words_word_index ON product_words(word);
+CREATE INDEX IF NOT EXISTS product_words_trgm_index ON product_words USING GIN (word gin_trgm_ops);
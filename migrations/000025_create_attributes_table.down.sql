@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('attributes:create', 'attributes:update', 'attributes:delete');
+DROP TABLE IF EXISTS product_attributes;
+DROP TABLE IF EXISTS attributes;
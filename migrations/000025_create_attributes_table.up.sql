@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS attributes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    category_id bigint REFERENCES categories(id) ON DELETE CASCADE,
+    code text UNIQUE NOT NULL,
+    name varchar(50) NOT NULL,
+    type text NOT NULL CHECK (type IN ('string', 'number', 'boolean', 'enum')),
+    unit text NOT NULL DEFAULT '',
+    enum_values text[] NOT NULL DEFAULT '{}',
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS attributes_category_id_index ON attributes(category_id);
+
+CREATE TABLE IF NOT EXISTS product_attributes (
+    product_id bigint NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    attribute_id bigint NOT NULL REFERENCES attributes(id) ON DELETE CASCADE,
+    value_text text,
+    value_number numeric,
+    value_boolean boolean,
+    PRIMARY KEY (product_id, attribute_id)
+);
+
+CREATE INDEX IF NOT EXISTS product_attributes_text_index ON product_attributes(attribute_id, value_text);
+CREATE INDEX IF NOT EXISTS product_attributes_number_index ON product_attributes(attribute_id, value_number);
+
+INSERT INTO permissions(code)
+VALUES
+('attributes:create'),
+('attributes:update'),
+('attributes:delete')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name IN ('admin', 'staff') AND p.code IN ('attributes:create', 'attributes:update', 'attributes:delete')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,28 @@
+INSERT INTO roles_permissions
+SELECT r.id, p.id FROM roles as r, permissions as p
+WHERE r.name = 'customer' AND p.code = 'products:read'
+ON CONFLICT DO NOTHING;
+INSERT INTO users_permissions
+SELECT u.id, p.id FROM users as u, permissions as p
+WHERE p.code = 'products:read'
+  AND NOT EXISTS (
+      SELECT 1 FROM users_roles as ur
+      INNER JOIN roles as r ON r.id = ur.role_id
+      WHERE ur.user_id = u.id AND r.name IN ('admin', 'staff')
+  )
+ON CONFLICT DO NOTHING;
+
+DROP MATERIALIZED VIEW IF EXISTS product_words;
+CREATE MATERIALIZED VIEW product_words AS
+SELECT word, ndoc
+FROM ts_stat('SELECT to_tsvector(''simple'', name) || to_tsvector(''simple'', description) FROM products');
+
+CREATE UNIQUE INDEX IF NOT EXISTS product_words_word_index ON product_words(word);
+CREATE INDEX IF NOT EXISTS product_words_trgm_index ON product_words USING GIN (word gin_trgm_ops);
+
+DROP INDEX IF EXISTS products_unpublish_at_index;
+DROP INDEX IF EXISTS products_publish_at_index;
+DROP INDEX IF EXISTS products_status_index;
+ALTER TABLE products DROP COLUMN IF EXISTS unpublish_at;
+ALTER TABLE products DROP COLUMN IF EXISTS publish_at;
+ALTER TABLE products DROP COLUMN IF EXISTS status;
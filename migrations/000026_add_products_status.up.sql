@@ -0,0 +1,34 @@
+-- products created before statuses existed were all visible, they stay so
+ALTER TABLE products ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published'
+    CHECK (status IN ('draft', 'published', 'archived'));
+ALTER TABLE products ALTER COLUMN status SET DEFAULT 'draft';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS publish_at timestamp(0) with time zone;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS unpublish_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS products_status_index ON products(status);
+CREATE INDEX IF NOT EXISTS products_publish_at_index ON products(publish_at) WHERE publish_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS products_unpublish_at_index ON products(unpublish_at) WHERE unpublish_at IS NOT NULL;
+
+-- did you mean suggestions must not leak the words of unpublished products
+DROP MATERIALIZED VIEW IF EXISTS product_words;
+CREATE MATERIALIZED VIEW product_words AS
+SELECT word, ndoc
+FROM ts_stat('SELECT to_tsvector(''simple'', name) || to_tsvector(''simple'', description) FROM products WHERE status = ''published''');
+
+CREATE UNIQUE INDEX IF NOT EXISTS product_words_word_index ON product_words(word);
+CREATE INDEX IF NOT EXISTS product_words_trgm_index ON product_words USING GIN (word gin_trgm_ops);
+
+-- published products are public, products:read now grants access to the
+-- unpublished ones and is kept for staff only
+DELETE FROM roles_permissions
+WHERE role_id = (SELECT id FROM roles WHERE name = 'customer')
+  AND permission_id = (SELECT id FROM permissions WHERE code = 'products:read');
+
+-- signups used to be granted products:read directly, only staff keep it
+DELETE FROM users_permissions as up
+WHERE up.permission_id = (SELECT id FROM permissions WHERE code = 'products:read')
+  AND NOT EXISTS (
+      SELECT 1 FROM users_roles as ur
+      INNER JOIN roles as r ON r.id = ur.role_id
+      WHERE ur.user_id = up.user_id AND r.name IN ('admin', 'staff')
+  );
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS product_imports;
+DROP INDEX IF EXISTS products_sku_index;
+ALTER TABLE products DROP COLUMN IF EXISTS sku;
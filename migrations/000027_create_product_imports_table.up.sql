@@ -0,0 +1,22 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sku text;
+CREATE UNIQUE INDEX IF NOT EXISTS products_sku_index ON products(sku);
+
+CREATE TABLE IF NOT EXISTS product_imports (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(0) with time zone,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    format text NOT NULL CHECK (format IN ('csv', 'ndjson')),
+    dry_run boolean NOT NULL DEFAULT FALSE,
+    status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    total_rows integer NOT NULL DEFAULT 0,
+    processed_rows integer NOT NULL DEFAULT 0,
+    created_rows integer NOT NULL DEFAULT 0,
+    updated_rows integer NOT NULL DEFAULT 0,
+    failed_rows integer NOT NULL DEFAULT 0,
+    errors jsonb NOT NULL DEFAULT '[]',
+    error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS product_imports_user_id_index ON product_imports(user_id);
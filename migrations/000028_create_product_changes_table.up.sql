@@ -0,0 +1,11 @@
+-- product_id has no foreign key so the history outlives deleted products
+CREATE TABLE IF NOT EXISTS product_changes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    product_id bigint NOT NULL,
+    user_id bigint REFERENCES users(id) ON DELETE SET NULL,
+    action text NOT NULL CHECK (action IN ('create', 'update', 'delete')),
+    changes jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS product_changes_product_id_index ON product_changes(product_id, id);